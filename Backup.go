@@ -0,0 +1,471 @@
+package nano
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// collectionState is the content of a collection at the time of a backup.
+// Collections without a registered type are not loaded, their files are copied instead.
+type collectionState struct {
+	namespace  string
+	name       string
+	collection *Collection
+	codec      Codec
+	records    []keyRecord
+	files      map[string][]byte
+}
+
+// backupFileExtensions are the extensions of the collection files that are copied
+// if the collection can't be loaded. The log is replayed on top of the snapshot after a Restore.
+var backupFileExtensions = []string{".dat", ".wal"}
+
+// Backup writes a tar archive with a snapshot of every collection in all namespaces
+// of the node. All collections are captured at the same instant, writes are blocked
+// only while the records are copied. Use Restore to extract the archive.
+// The files of collections without a registered type are copied as they are.
+// Clients can only back up collections with a registered type, because they don't store files.
+// Lazy clients only know some of the keys, so they can't create backups.
+func (node *Node) Backup(writer io.Writer) error {
+	names, err := node.Namespaces()
+
+	if err != nil {
+		return err
+	}
+
+	node.namespaces.Range(func(key, value interface{}) bool {
+		if value != nil && !containsString(names, key.(string)) {
+			names = append(names, key.(string))
+		}
+
+		return true
+	})
+
+	sort.Strings(names)
+	namespaces := make([]*Namespace, len(names))
+
+	for i, name := range names {
+		namespaces[i], err = node.NamespaceE(name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	states, err := captureCollections(namespaces)
+
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(writer)
+	now := time.Now()
+
+	for _, state := range states {
+		files, err := state.encode()
+
+		if err != nil {
+			return err
+		}
+
+		for _, extension := range backupFileExtensions {
+			data, exists := files[extension]
+
+			if !exists {
+				continue
+			}
+
+			err = archive.WriteHeader(&tar.Header{
+				Name:    path.Join(state.namespace, state.name+extension),
+				Mode:    0644,
+				Size:    int64(len(data)),
+				ModTime: now,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			_, err = archive.Write(data)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+// Snapshot writes the files of all collections in the namespace to the directory.
+// All collections are captured at the same instant. The directory can be used
+// as the namespace directory of a new node. Like in Backup, the files of collections
+// without a registered type are copied. Lazy clients can't create snapshots.
+func (ns *Namespace) Snapshot(directory string) error {
+	target, err := filepath.Abs(directory)
+
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(ns.root)
+
+	if err != nil {
+		return err
+	}
+
+	if target == root {
+		return errors.New("Snapshot can't overwrite the files of namespace " + ns.name)
+	}
+
+	states, err := captureCollections([]*Namespace{ns})
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(directory, 0777)
+
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		files, err := state.encode()
+
+		if err != nil {
+			return err
+		}
+
+		for _, extension := range backupFileExtensions {
+			data, exists := files[extension]
+
+			if !exists {
+				continue
+			}
+
+			err = writeFileSync(path.Join(directory, state.name+extension), data, os.O_TRUNC)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return syncDirectory(directory)
+}
+
+// Restore extracts an archive created by Backup into the directory of a new node.
+// It fails without writing any file if the archive is invalid or one of the collection
+// files already exists. Files that have been written are removed if a write fails.
+func Restore(reader io.Reader, directory string) error {
+	archive := tar.NewReader(reader)
+	files := map[string][]byte{}
+	names := []string{}
+
+	for {
+		header, err := archive.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Files need to be collection files inside of a namespace directory
+		name := header.Name
+
+		if path.Clean(name) != name || strings.Count(name, "/") != 1 || strings.HasPrefix(name, "../") || !containsString(backupFileExtensions, path.Ext(name)) {
+			return errors.New("Invalid file in backup: " + name)
+		}
+
+		_, duplicate := files[name]
+
+		if duplicate {
+			return errors.New("Duplicate file in backup: " + name)
+		}
+
+		data, err := io.ReadAll(archive)
+
+		if err != nil {
+			return err
+		}
+
+		files[name] = data
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		_, err := os.Stat(path.Join(directory, name))
+
+		if err == nil {
+			return errors.New("File already exists: " + path.Join(directory, name))
+		}
+
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	namespaces := map[string]bool{}
+
+	for i, name := range names {
+		namespace := path.Dir(name)
+		err := os.MkdirAll(path.Join(directory, namespace), 0777)
+
+		if err == nil {
+			err = writeFileSync(path.Join(directory, name), files[name], os.O_EXCL)
+		}
+
+		if err != nil {
+			for _, written := range names[:i] {
+				os.Remove(path.Join(directory, written))
+			}
+
+			return err
+		}
+
+		namespaces[namespace] = true
+	}
+
+	for namespace := range namespaces {
+		err := syncDirectory(path.Join(directory, namespace))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// captureCollections loads all registered collections of the namespaces and copies their records
+// while writes to all of them are blocked, so that the result reflects a single instant.
+// Servers copy the files of collections without a registered type while nobody can load them.
+// Clients return an error listing these collections instead.
+func captureCollections(namespaces []*Namespace) ([]collectionState, error) {
+	states := []collectionState{}
+	collections := []*Collection{}
+	skipped := []string{}
+
+	// Loading the reserved collections waits until their files have been copied
+	defer func() {
+		for _, state := range states {
+			if state.collection == nil {
+				namespaceByName(namespaces, state.namespace).collections.Delete(state.name)
+			}
+		}
+	}()
+
+	for _, ns := range namespaces {
+		if ns.node.config.Lazy && !ns.node.IsServer() {
+			return nil, errors.New("Lazy clients can't back up namespace " + ns.name + ", they only know some of its keys")
+		}
+
+		names, err := ns.collectionNames()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			if !ns.HasType(name) && !ns.node.IsServer() {
+				skipped = append(skipped, ns.name+"/"+name)
+				continue
+			}
+
+			if !ns.HasType(name) {
+				_, loaded := ns.collections.LoadOrStore(name, nil)
+
+				if !loaded {
+					states = append(states, collectionState{namespace: ns.name, name: name})
+					continue
+				}
+			}
+
+			collection, err := ns.CollectionE(name)
+
+			if err != nil {
+				return nil, err
+			}
+
+			collections = append(collections, collection)
+		}
+	}
+
+	if len(skipped) > 0 {
+		return nil, errors.New("Collections without a registered type can't be backed up by a client: " + strings.Join(skipped, ", "))
+	}
+
+	for _, collection := range collections {
+		for i := range collection.keyLocks {
+			collection.keyLocks[i].Lock()
+		}
+	}
+
+	for _, collection := range collections {
+		states = append(states, collectionState{
+			namespace:  collection.ns.name,
+			name:       collection.name,
+			collection: collection,
+			codec:      collection.Codec(),
+			records:    collection.records(true, false),
+		})
+	}
+
+	for _, collection := range collections {
+		for i := range collection.keyLocks {
+			collection.keyLocks[i].Unlock()
+		}
+	}
+
+	for i := range states {
+		if states[i].collection != nil {
+			continue
+		}
+
+		err := states[i].copyFiles(namespaceByName(namespaces, states[i].namespace))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].namespace != states[j].namespace {
+			return states[i].namespace < states[j].namespace
+		}
+
+		return states[i].name < states[j].name
+	})
+
+	return states, nil
+}
+
+// collectionNames returns the sorted names of all registered collections
+// and all collections stored by the server.
+func (ns *Namespace) collectionNames() ([]string, error) {
+	infos, err := ns.node.Collections(ns.name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for name := range ns.Types() {
+		names = append(names, name)
+	}
+
+	for _, info := range infos {
+		if !containsString(names, info.Name) {
+			names = append(names, info.Name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// copyFiles reads the files of a collection that has not been loaded.
+func (state *collectionState) copyFiles(ns *Namespace) error {
+	state.files = map[string][]byte{}
+
+	for _, extension := range backupFileExtensions {
+		data, err := os.ReadFile(path.Join(ns.root, state.name+extension))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		state.files[extension] = data
+	}
+
+	return nil
+}
+
+// encode returns the files of the state by their extension.
+// Loaded collections are stored as a snapshot file.
+func (state *collectionState) encode() (map[string][]byte, error) {
+	if state.collection == nil {
+		return state.files, nil
+	}
+
+	buffer := bytes.Buffer{}
+	writer := bufio.NewWriter(&buffer)
+	err := writeFileHeader(writer, state.codec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = state.collection.writeSnapshotRecords(writer, state.codec, state.records)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Flush()
+	return map[string][]byte{".dat": buffer.Bytes()}, err
+}
+
+// namespaceByName returns the namespace with the given name.
+func namespaceByName(namespaces []*Namespace, name string) *Namespace {
+	for _, ns := range namespaces {
+		if ns.name == name {
+			return ns
+		}
+	}
+
+	return nil
+}
+
+// containsString reports whether the list contains the string.
+func containsString(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeFileSync writes the data to a new file and waits until it is stored on the disk.
+// The flag decides whether an existing file is truncated or an error.
+func writeFileSync(filePath string, data []byte, flag int) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|flag, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
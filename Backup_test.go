@@ -0,0 +1,163 @@
+package nano_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestBackup(t *testing.T) {
+	node := nano.New(config)
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	for i := 0; i < 10; i++ {
+		users.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	users.Delete("0")
+
+	backup := bytes.Buffer{}
+	assert.Nil(t, node.Backup(&backup))
+
+	snapshotDirectory := path.Join(t.TempDir(), "test")
+	assert.Nil(t, node.Namespace("test").Snapshot(snapshotDirectory))
+	assert.NotNil(t, node.Namespace("test").Snapshot(namespaceDirectory("test")))
+
+	node.Clear()
+	node.Close()
+
+	// Restore the backup into a new directory
+	restoreDirectory := t.TempDir()
+	archive := backup.Bytes()
+	assert.Nil(t, nano.Restore(bytes.NewReader(archive), restoreDirectory))
+
+	// Conflicts are detected before anything is written
+	conflictDirectory := t.TempDir()
+	assert.Nil(t, os.MkdirAll(path.Join(conflictDirectory, "test"), 0777))
+	assert.Nil(t, os.WriteFile(path.Join(conflictDirectory, "test", "User.dat"), nil, 0644))
+	assert.NotNil(t, nano.Restore(bytes.NewReader(archive), restoreDirectory))
+	assert.NotNil(t, nano.Restore(bytes.NewReader(archive), conflictDirectory))
+	entries, err := os.ReadDir(path.Join(conflictDirectory, "test"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	for _, directory := range []string{restoreDirectory, path.Dir(snapshotDirectory)} {
+		restoreConfig := config
+		restoreConfig.Directory = directory
+
+		node = nano.New(restoreConfig)
+		users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+		assert.Equal(t, int64(9), users.Count())
+		assert.False(t, users.Exists("0"))
+
+		user, err := users.Get("9")
+		assert.Nil(t, err)
+		assert.DeepEqual(t, newUser(9), user)
+		node.Close()
+	}
+}
+
+func TestBackupConcurrentWrites(t *testing.T) {
+	writeConfig := config
+	writeConfig.Directory = t.TempDir()
+	node := nano.New(writeConfig)
+	ns := node.Namespace("test").RegisterTypes(types...).RegisterTypeAs("Author", (*User)(nil))
+	authors := ns.Collection("Author")
+	users := ns.Collection("User")
+	stop := int32(0)
+	stopped := make(chan struct{})
+
+	// Every user is written right after the author with the same key
+	go func() {
+		for i := 0; i < 2000 && atomic.LoadInt32(&stop) == 0; i++ {
+			authors.Set(strconv.Itoa(i), newUser(i))
+			users.Set(strconv.Itoa(i), newUser(i))
+		}
+
+		close(stopped)
+	}()
+
+	directories := []string{}
+
+	for i := 0; i < 5; i++ {
+		directory := t.TempDir()
+		assert.Nil(t, ns.Snapshot(path.Join(directory, "test")))
+		directories = append(directories, directory)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	atomic.StoreInt32(&stop, 1)
+	<-stopped
+	node.Close()
+
+	// A single instant never contains more authors than users plus the one being written
+	for _, directory := range directories {
+		snapshotConfig := config
+		snapshotConfig.Directory = directory
+
+		node = nano.New(snapshotConfig)
+		ns = node.Namespace("test").RegisterTypes(types...).RegisterTypeAs("Author", (*User)(nil))
+		authorCount := ns.Collection("Author").Count()
+		userCount := ns.Collection("User").Count()
+		assert.True(t, userCount <= authorCount && authorCount <= userCount+1)
+		node.Close()
+	}
+}
+
+func TestBackupUnregistered(t *testing.T) {
+	backupConfig := config
+	backupConfig.Directory = t.TempDir()
+	node := nano.New(backupConfig)
+	node.Namespace("test").RegisterTypeAs("Author", (*User)(nil)).Collection("Author").Set("1", newUser(1))
+	node.Namespace("other").RegisterTypes(types...).Collection("User").Set("2", newUser(2))
+	node.Close()
+
+	// Collections and namespaces that haven't been loaded are copied
+	node = nano.New(backupConfig)
+	node.Namespace("test").RegisterTypes(types...).Collection("User").Set("3", newUser(3))
+	client := nano.New(backupConfig)
+	client.Namespace("test").RegisterTypes(types...)
+
+	backup := bytes.Buffer{}
+	assert.Nil(t, node.Backup(&backup))
+
+	// Clients don't have the files of collections without a registered type
+	err := client.Backup(&bytes.Buffer{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "test/Author")
+	client.Close()
+	node.Close()
+
+	restoreConfig := config
+	restoreConfig.Directory = t.TempDir()
+	assert.Nil(t, nano.Restore(&backup, restoreConfig.Directory))
+
+	node = nano.New(restoreConfig)
+	defer node.Close()
+
+	assert.True(t, node.Namespace("test").RegisterTypeAs("Author", (*User)(nil)).Collection("Author").Exists("1"))
+	assert.True(t, node.Namespace("other").RegisterTypes(types...).Collection("User").Exists("2"))
+	assert.True(t, node.Namespace("test").RegisterTypes(types...).Collection("User").Exists("3"))
+}
+
+func TestBackupLazy(t *testing.T) {
+	server := nano.New(config)
+	defer server.Close()
+	defer server.Clear()
+
+	clientConfig := config
+	clientConfig.Lazy = true
+	client := nano.New(clientConfig)
+	defer client.Close()
+
+	client.Namespace("test").RegisterTypes(types...)
+	assert.NotNil(t, client.Backup(&bytes.Buffer{}))
+	assert.NotNil(t, client.Namespace("test").Snapshot(t.TempDir()))
+}
@@ -0,0 +1,205 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/aerogo/packet"
+)
+
+// Batch collects multiple modifications of a collection
+// that are applied together and sent as a single network packet.
+type Batch struct {
+	collection *Collection
+	operations []batchOperation
+}
+
+// batchOperation is a single set or delete inside a batch.
+// A nil value means that the key is deleted.
+type batchOperation struct {
+	key   string
+	value interface{}
+}
+
+// Batch returns a new, empty batch for the collection.
+func (collection *Collection) Batch() *Batch {
+	return &Batch{
+		collection: collection,
+	}
+}
+
+// Set adds a set operation to the batch.
+func (batch *Batch) Set(key string, value interface{}) *Batch {
+	if value == nil {
+		return batch
+	}
+
+	batch.operations = append(batch.operations, batchOperation{
+		key:   key,
+		value: value,
+	})
+
+	return batch
+}
+
+// Delete adds a delete operation to the batch.
+func (batch *Batch) Delete(key string) *Batch {
+	batch.operations = append(batch.operations, batchOperation{
+		key: key,
+	})
+
+	return batch
+}
+
+// Len returns the number of operations in the batch.
+func (batch *Batch) Len() int {
+	return len(batch.operations)
+}
+
+// Commit applies all operations of the batch and notifies the other nodes
+// with a single network packet. Writes to the affected keys by other goroutines
+// are blocked until all operations have been applied.
+func (batch *Batch) Commit() error {
+	if len(batch.operations) == 0 {
+		return nil
+	}
+
+	collection := batch.collection
+	locks := batch.lockIndices()
+
+	for _, index := range locks {
+		collection.keyLocks[index].Lock()
+	}
+
+	defer func() {
+		for _, index := range locks {
+			collection.keyLocks[index].Unlock()
+		}
+	}()
+
+	now := collection.node.clock.now()
+	broadcast := collection.node.broadcastRequired()
+	sent := false
+
+	// Values that can't be serialized are rejected before anything is applied
+	encoded, err := batch.encode()
+
+	if err != nil {
+		return err
+	}
+
+	if broadcast {
+		msg, err := batch.packet(now, encoded)
+
+		if err != nil {
+			return err
+		}
+
+		// It's important to store the timestamps BEFORE the actual modification
+		for _, operation := range batch.operations {
+			collection.lastModification.Store(operation.key, now)
+		}
+
+		sent = collection.node.broadcast(msg)
+	}
+
+	for i, operation := range batch.operations {
+		if !sent {
+			collection.markUnsynced(operation.key, now)
+		}
+
+		collection.apply(operation.key, operation.value, 0, now, OriginLocal)
+
+		if collection.node.IsServer() {
+			collection.pending.Store(operation.key, encoded[i])
+		}
+	}
+
+	if !collection.node.IsServer() {
+		return nil
+	}
+
+	return collection.persist()
+}
+
+// lockIndices returns the sorted indices of all key locks needed by the batch.
+// Acquiring the locks in a fixed order prevents deadlocks between batches.
+func (batch *Batch) lockIndices() []int {
+	used := map[int]bool{}
+	indices := make([]int, 0, len(batch.operations))
+
+	for _, operation := range batch.operations {
+		index := keyLockIndex(operation.key)
+
+		if used[index] {
+			continue
+		}
+
+		used[index] = true
+		indices = append(indices, index)
+	}
+
+	sort.Ints(indices)
+	return indices
+}
+
+// encode serializes the values of all set operations.
+// Delete operations have a nil value.
+func (batch *Batch) encode() ([]*encodedValue, error) {
+	encoded := make([]*encodedValue, len(batch.operations))
+
+	for i, operation := range batch.operations {
+		if operation.value == nil {
+			continue
+		}
+
+		var err error
+		encoded[i], err = batch.collection.encode(operation.value)
+
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding batch operation for key %s: %w", operation.key, err)
+		}
+	}
+
+	return encoded, nil
+}
+
+// packet creates the network packet for the batch from the encoded values.
+func (batch *Batch) packet(timestamp int64, encoded []*encodedValue) (*packet.Packet, error) {
+	buffer := bytes.Buffer{}
+	buffer.Write(packet.Int64ToBytes(timestamp))
+	buffer.WriteString(batch.collection.ns.name)
+	buffer.WriteByte('\n')
+	buffer.WriteString(batch.collection.name)
+	buffer.WriteByte('\n')
+
+	writer := bufio.NewWriter(&buffer)
+
+	for i, operation := range batch.operations {
+		if operation.value == nil {
+			err := writeLogRecord(writer, logDelete, operation.key, keyMetadata{}, nil)
+
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		err := writeLogRecord(writer, logSet, operation.key, keyMetadata{}, encoded[i].line())
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writer.Flush()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return packet.New(packetBatch, buffer.Bytes()), nil
+}
@@ -0,0 +1,583 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Format is a text format for importing and exporting collections.
+type Format string
+
+const (
+	// NDJSON stores one JSON object per line with the key and the value,
+	// e.g. {"key":"1","value":{"Name":"Test"}}.
+	NDJSON Format = "ndjson"
+
+	// CSV stores one row per key. The first column is the key,
+	// the other columns are the flattened fields of the struct type,
+	// e.g. Address.City for the City field of a nested Address struct.
+	// Empty cells are imported as zero values, so a pointer to an empty string
+	// is exported as an empty cell and imported as a nil pointer.
+	CSV Format = "csv"
+)
+
+// importBatchSize is the number of rows that are committed together by Import.
+const importBatchSize = 1000
+
+// textMarshaler and textUnmarshaler are used to detect types with their own text representation.
+var (
+	textMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// ndjsonRecord is a single line of the NDJSON format.
+type ndjsonRecord struct {
+	Key   string              `json:"key"`
+	Value jsoniter.RawMessage `json:"value"`
+}
+
+// csvColumn is a struct field that is stored in a CSV column.
+type csvColumn struct {
+	name  string
+	index []int
+}
+
+// RowError describes a row that could not be imported.
+type RowError struct {
+	Line int
+	Key  string
+	Err  error
+}
+
+// Error returns the line and the reason.
+func (err *RowError) Error() string {
+	return "Line " + strconv.Itoa(err.Line) + ": " + err.Err.Error()
+}
+
+// Unwrap returns the reason.
+func (err *RowError) Unwrap() error {
+	return err.Err
+}
+
+// ImportError lists the rows that have been skipped by Import.
+type ImportError struct {
+	Rows []*RowError
+}
+
+// Error returns the number of skipped rows and the first reason.
+func (err *ImportError) Error() string {
+	return strconv.Itoa(len(err.Rows)) + " rows could not be imported, first error: " + err.Rows[0].Error()
+}
+
+// Export writes all keys and values of the collection sorted by key in the given format.
+// Lazy clients only export the keys they know.
+func (collection *Collection) Export(writer io.Writer, format Format) error {
+	records := collection.records(true, false)
+
+	switch format {
+	case NDJSON:
+		buffered := bufio.NewWriter(writer)
+
+		for _, record := range records {
+			if record.Value == nil {
+				continue
+			}
+
+			value, err := jsoniter.Marshal(record.Value)
+
+			if err != nil {
+				return err
+			}
+
+			line, err := jsoniter.Marshal(ndjsonRecord{Key: record.Key, Value: value})
+
+			if err != nil {
+				return err
+			}
+
+			buffered.Write(line)
+			buffered.WriteByte('\n')
+		}
+
+		return buffered.Flush()
+
+	case CSV:
+		columns, err := collection.csvColumns()
+
+		if err != nil {
+			return err
+		}
+
+		csvWriter := csv.NewWriter(writer)
+		row := make([]string, len(columns)+1)
+		row[0] = "key"
+
+		for i, column := range columns {
+			row[i+1] = column.name
+		}
+
+		err = csvWriter.Write(row)
+
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			if record.Value == nil {
+				continue
+			}
+
+			value := reflect.Indirect(reflect.ValueOf(record.Value))
+			row[0] = record.Key
+
+			for i, column := range columns {
+				row[i+1], err = formatCell(value.FieldByIndex(column.index))
+
+				if err != nil {
+					return errors.New("Key " + record.Key + ": " + err.Error())
+				}
+			}
+
+			err = csvWriter.Write(row)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		csvWriter.Flush()
+		return csvWriter.Error()
+
+	default:
+		return errors.New("Unknown format: " + string(format))
+	}
+}
+
+// Import reads keys and values in the given format, decodes the values into the
+// type of the collection and sets them in batches. Rows that can't be decoded or
+// serialized are skipped and reported in an *ImportError after all other rows
+// have been imported. Other errors, e.g. writing to disk, stop the import and
+// the rows imported before remain in the collection.
+// It returns the number of imported rows.
+func (collection *Collection) Import(reader io.Reader, format Format) (int, error) {
+	importer := &importer{
+		collection: collection,
+		batch:      collection.Batch(),
+	}
+
+	var err error
+
+	switch format {
+	case NDJSON:
+		err = importer.ndjson(reader)
+
+	case CSV:
+		err = importer.csv(reader)
+
+	default:
+		return 0, errors.New("Unknown format: " + string(format))
+	}
+
+	if err == nil {
+		err = importer.commit()
+	}
+
+	if err != nil {
+		return importer.imported, err
+	}
+
+	if len(importer.rowErrors) > 0 {
+		// Rows rejected while committing are added after the rows that follow them
+		sort.SliceStable(importer.rowErrors, func(i, j int) bool {
+			return importer.rowErrors[i].Line < importer.rowErrors[j].Line
+		})
+
+		return importer.imported, &ImportError{Rows: importer.rowErrors}
+	}
+
+	return importer.imported, nil
+}
+
+// importer collects the rows of an import in batches.
+type importer struct {
+	collection *Collection
+	batch      *Batch
+	lines      []int
+	imported   int
+	rowErrors  []*RowError
+}
+
+// add imports a decoded row or remembers why it could not be decoded.
+// The batch is committed as soon as it is full.
+func (importer *importer) add(line int, key string, value interface{}, err error) error {
+	if err != nil {
+		importer.reject(line, key, err)
+		return nil
+	}
+
+	importer.batch.Set(key, value)
+	importer.lines = append(importer.lines, line)
+
+	if importer.batch.Len() < importBatchSize {
+		return nil
+	}
+
+	return importer.commit()
+}
+
+// reject remembers why the row could not be imported.
+func (importer *importer) reject(line int, key string, err error) {
+	importer.rowErrors = append(importer.rowErrors, &RowError{
+		Line: line,
+		Key:  key,
+		Err:  err,
+	})
+}
+
+// commit applies the rows of the current batch. If the batch is rejected because
+// a value can't be serialized, the rows are set one by one to find out
+// which of them need to be skipped.
+func (importer *importer) commit() error {
+	batch := importer.batch
+	lines := importer.lines
+	importer.batch = importer.collection.Batch()
+	importer.lines = nil
+
+	err := batch.Commit()
+	var encodingErr *encodingError
+
+	if !errors.As(err, &encodingErr) {
+		if err == nil {
+			importer.imported += batch.Len()
+		}
+
+		return err
+	}
+
+	for i, operation := range batch.operations {
+		err := importer.collection.SetE(operation.key, operation.value)
+
+		if errors.As(err, &encodingErr) {
+			importer.reject(lines[i], operation.key, err)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		importer.imported++
+	}
+
+	return nil
+}
+
+// ndjson imports one JSON object with the key and the value per line.
+func (importer *importer) ndjson(reader io.Reader) error {
+	buffered := bufio.NewReader(reader)
+
+	for line := 1; ; line++ {
+		data, readErr := buffered.ReadBytes('\n')
+
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		if len(bytes.TrimSpace(data)) > 0 {
+			key, value, err := importer.decodeNDJSON(data)
+			err = importer.add(line, key, value, err)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// decodeNDJSON decodes a single NDJSON line into the key and a new object of the collection type.
+func (importer *importer) decodeNDJSON(data []byte) (string, interface{}, error) {
+	record := ndjsonRecord{}
+	err := jsoniter.Unmarshal(data, &record)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if record.Key == "" {
+		return "", nil, errors.New("Missing key")
+	}
+
+	if len(record.Value) == 0 || string(record.Value) == "null" {
+		return record.Key, nil, errors.New("Missing value")
+	}
+
+	value := reflect.New(importer.collection.typ).Interface()
+	err = jsoniter.Unmarshal(record.Value, value)
+	return record.Key, value, err
+}
+
+// csv imports one row per key. The header needs to start with the key column,
+// fields without a column keep their zero value.
+func (importer *importer) csv(reader io.Reader) error {
+	columns, err := importer.collection.csvColumns()
+
+	if err != nil {
+		return err
+	}
+
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if header[0] != "key" {
+		return errors.New("The first CSV column must be the key")
+	}
+
+	byName := map[string]csvColumn{}
+
+	for _, column := range columns {
+		byName[column.name] = column
+	}
+
+	headerColumns := make([]csvColumn, len(header)-1)
+
+	for i, name := range header[1:] {
+		column, exists := byName[name]
+
+		if !exists {
+			return errors.New("Unknown CSV column: " + name)
+		}
+
+		headerColumns[i] = column
+	}
+
+	for {
+		row, err := csvReader.Read()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		line, _ := csvReader.FieldPos(0)
+		value, err := importer.decodeCSV(row, len(header), headerColumns)
+		err = importer.add(line, row[0], value, err)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeCSV decodes the cells of a CSV row into a new object of the collection type.
+func (importer *importer) decodeCSV(row []string, length int, columns []csvColumn) (interface{}, error) {
+	if len(row) != length {
+		return nil, errors.New("Expected " + strconv.Itoa(length) + " columns instead of " + strconv.Itoa(len(row)))
+	}
+
+	if row[0] == "" {
+		return nil, errors.New("Missing key")
+	}
+
+	value := reflect.New(importer.collection.typ)
+
+	for i, column := range columns {
+		cell := row[i+1]
+
+		if cell == "" {
+			continue
+		}
+
+		err := parseCell(value.Elem().FieldByIndex(column.index), cell)
+
+		if err != nil {
+			return nil, errors.New(column.name + ": " + err.Error())
+		}
+	}
+
+	return value.Interface(), nil
+}
+
+// csvColumns returns the flattened fields of the collection type.
+func (collection *Collection) csvColumns() ([]csvColumn, error) {
+	if collection.typ.Kind() != reflect.Struct {
+		return nil, errors.New("CSV requires a struct type, collection " + collection.name + " uses " + collection.typ.String())
+	}
+
+	return appendColumns(nil, collection.typ, "", nil), nil
+}
+
+// appendColumns adds the exported fields of the struct type to the columns.
+// Nested structs are flattened, their column names start with the name of the field.
+// Fields of embedded structs are added without a prefix.
+func appendColumns(columns []csvColumn, typ reflect.Type, prefix string, index []int) []csvColumn {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		nested := field.Type.Kind() == reflect.Struct && !hasTextFormat(field.Type)
+
+		if !field.IsExported() && !(field.Anonymous && nested) {
+			continue
+		}
+
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if !nested {
+			columns = append(columns, csvColumn{
+				name:  prefix + field.Name,
+				index: fieldIndex,
+			})
+
+			continue
+		}
+
+		if field.Anonymous {
+			columns = appendColumns(columns, field.Type, prefix, fieldIndex)
+		} else {
+			columns = appendColumns(columns, field.Type, prefix+field.Name+".", fieldIndex)
+		}
+	}
+
+	return columns
+}
+
+// hasTextFormat reports whether the type converts itself from and to text, e.g. time.Time.
+func hasTextFormat(typ reflect.Type) bool {
+	pointer := reflect.PointerTo(typ)
+	return pointer.Implements(textMarshaler) && pointer.Implements(textUnmarshaler)
+}
+
+// formatCell returns the text of a CSV cell. Nil pointers, slices and maps are empty,
+// just like pointers to empty strings. Values without a text representation are stored as JSON.
+func formatCell(value reflect.Value) (string, error) {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+		if value.IsNil() {
+			return "", nil
+		}
+	}
+
+	if value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+
+	if hasTextFormat(value.Type()) {
+		if !value.CanAddr() {
+			copied := reflect.New(value.Type())
+			copied.Elem().Set(value)
+			value = copied.Elem()
+		}
+
+		text, err := value.Addr().Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), nil
+
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool()), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10), nil
+
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits()), nil
+
+	default:
+		data, err := jsoniter.Marshal(value.Interface())
+		return string(data), err
+	}
+}
+
+// parseCell stores the text of a CSV cell in the field.
+func parseCell(value reflect.Value, cell string) error {
+	if value.Kind() == reflect.Pointer {
+		target := reflect.New(value.Type().Elem())
+		err := parseCell(target.Elem(), cell)
+
+		if err != nil {
+			return err
+		}
+
+		value.Set(target)
+		return nil
+	}
+
+	if hasTextFormat(value.Type()) {
+		return value.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(cell))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(cell)
+
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(cell)
+
+		if err != nil {
+			return err
+		}
+
+		value.SetBool(parsed)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(cell, 10, value.Type().Bits())
+
+		if err != nil {
+			return err
+		}
+
+		value.SetInt(parsed)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(cell, 10, value.Type().Bits())
+
+		if err != nil {
+			return err
+		}
+
+		value.SetUint(parsed)
+
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(cell, value.Type().Bits())
+
+		if err != nil {
+			return err
+		}
+
+		value.SetFloat(parsed)
+
+	default:
+		return jsoniter.Unmarshal([]byte(cell), value.Addr().Interface())
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package nano_test
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+type Address struct {
+	City string
+	Zip  int
+}
+
+type Customer struct {
+	Name    string
+	Age     int
+	Active  bool
+	Joined  time.Time
+	Address Address
+	Manager *string
+	Tags    []string
+}
+
+func TestExportImport(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	for i := 0; i < 1500; i++ {
+		users.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	for _, format := range []nano.Format{nano.NDJSON, nano.CSV} {
+		exported := bytes.Buffer{}
+		assert.Nil(t, users.Export(&exported, format))
+
+		users.Clear()
+		assert.Equal(t, int64(0), users.Count())
+
+		imported, err := users.Import(bytes.NewReader(exported.Bytes()), format)
+		assert.Nil(t, err)
+		assert.Equal(t, 1500, imported)
+		assert.Equal(t, int64(1500), users.Count())
+
+		user, err := users.Get("1499")
+		assert.Nil(t, err)
+		assert.DeepEqual(t, newUser(1499), user)
+	}
+
+	// Imported objects are indexed
+	accounts := node.Namespace("test").RegisterTypes((*Account)(nil)).Collection("Account")
+	accounts.Set("1", newAccount(1))
+	exported := bytes.Buffer{}
+	assert.Nil(t, accounts.Export(&exported, nano.NDJSON))
+	accounts.Clear()
+
+	_, err := accounts.Import(&exported, nano.NDJSON)
+	assert.Nil(t, err)
+	keys, err := accounts.FindKeysBy("Email", "user1@example.com")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, []string{"1"}, keys)
+
+	assert.NotNil(t, users.Export(&bytes.Buffer{}, "xml"))
+	_, err = users.Import(strings.NewReader(""), "xml")
+	assert.NotNil(t, err)
+}
+
+func TestExportCSV(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	customers := node.Namespace("test").RegisterTypeAs("Customer", (*Customer)(nil)).Collection("Customer")
+	manager := "Alice"
+
+	customers.Set("1", &Customer{
+		Name:    "Bob, Jr.",
+		Age:     42,
+		Active:  true,
+		Joined:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Address: Address{City: "Tokyo", Zip: 100},
+		Manager: &manager,
+		Tags:    []string{"a", "b"},
+	})
+
+	customers.Set("2", &Customer{Name: "Carol"})
+
+	exported := bytes.Buffer{}
+	assert.Nil(t, customers.Export(&exported, nano.CSV))
+	assert.Equal(t, `key,Name,Age,Active,Joined,Address.City,Address.Zip,Manager,Tags
+1,"Bob, Jr.",42,true,2020-01-02T03:04:05Z,Tokyo,100,Alice,"[""a"",""b""]"
+2,Carol,0,false,0001-01-01T00:00:00Z,,0,,
+`, exported.String())
+
+	customers.Clear()
+	imported, err := customers.Import(bytes.NewReader(exported.Bytes()), nano.CSV)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, imported)
+
+	customer, err := customers.Get("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Alice", *customer.(*Customer).Manager)
+	assert.Equal(t, "Tokyo", customer.(*Customer).Address.City)
+	assert.True(t, customer.(*Customer).Joined.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	customer, err = customers.Get("2")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, &Customer{Name: "Carol"}, customer)
+
+	// Unknown columns are rejected
+	_, err = customers.Import(strings.NewReader("key,Unknown\n3,x\n"), nano.CSV)
+	assert.NotNil(t, err)
+	assert.False(t, customers.Exists("3"))
+}
+
+func TestImportRowErrors(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	customers := node.Namespace("test").RegisterTypeAs("Customer", (*Customer)(nil)).Collection("Customer")
+
+	ndjson := `{"key":"1","value":{"Name":"First"}}
+{"key":"2","value":{"Age":"old"}}
+
+{"value":{"Name":"No key"}}
+{"key":"3"}
+not json
+{"key":"4","value":{"Name":"Fourth"}}
+`
+
+	imported, err := customers.Import(strings.NewReader(ndjson), nano.NDJSON)
+	assert.Equal(t, 2, imported)
+	assert.True(t, customers.Exists("1"))
+	assert.True(t, customers.Exists("4"))
+	assert.False(t, customers.Exists("2"))
+
+	var importErr *nano.ImportError
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 4, len(importErr.Rows))
+	assert.Equal(t, 2, importErr.Rows[0].Line)
+	assert.Equal(t, "2", importErr.Rows[0].Key)
+	assert.Equal(t, 4, importErr.Rows[1].Line)
+	assert.Equal(t, 5, importErr.Rows[2].Line)
+	assert.Equal(t, 6, importErr.Rows[3].Line)
+
+	csv := "key,Name,Age\n5,Fifth,5\n6,Sixth,six\n7,Seventh\n,Nobody,1\n"
+	imported, err = customers.Import(strings.NewReader(csv), nano.CSV)
+	assert.Equal(t, 1, imported)
+	assert.True(t, customers.Exists("5"))
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 3, len(importErr.Rows))
+	assert.Equal(t, 3, importErr.Rows[0].Line)
+	assert.Equal(t, "6", importErr.Rows[0].Key)
+	assert.Equal(t, 4, importErr.Rows[1].Line)
+	assert.Equal(t, 5, importErr.Rows[2].Line)
+
+	// Values that can't be serialized are found when the batch is committed
+	type Measurement struct {
+		Value float64
+	}
+
+	measurements := node.Namespace("test").RegisterTypeAs("Measurement", (*Measurement)(nil)).Collection("Measurement")
+	csv = "key,Value\n8,1.5\n9,NaN\n10,high\n11,2.5\n"
+
+	imported, err = measurements.Import(strings.NewReader(csv), nano.CSV)
+	assert.Equal(t, 2, imported)
+	assert.True(t, measurements.Exists("8"))
+	assert.True(t, measurements.Exists("11"))
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 2, len(importErr.Rows))
+	assert.Equal(t, 3, importErr.Rows[0].Line)
+	assert.Equal(t, "9", importErr.Rows[0].Key)
+	assert.Equal(t, 4, importErr.Rows[1].Line)
+}
@@ -0,0 +1,240 @@
+package nano
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aerogo/packet"
+)
+
+// listTimeout is the maximum time a client waits for the server to answer a list request.
+const listTimeout = 5 * time.Second
+
+// CollectionInfo describes a collection stored by the server.
+type CollectionInfo struct {
+	Name string
+
+	// Codec is the name of the codec the values are stored with.
+	Codec string
+}
+
+// Namespaces returns the names of all namespaces stored by the server.
+// Clients ask the server instead of reading their own directory.
+func (node *Node) Namespaces() ([]string, error) {
+	if !node.IsServer() {
+		return node.requestList("namespaces")
+	}
+
+	entries, err := os.ReadDir(node.config.Directory)
+
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Collections returns the collections of the namespace stored by the server,
+// sorted by their names. This includes loaded collections that haven't been written yet.
+// Clients ask the server instead of reading their own directory.
+func (node *Node) Collections(namespace string) ([]CollectionInfo, error) {
+	if !node.IsServer() {
+		lines, err := node.requestList("collections", namespace)
+
+		if err != nil {
+			return nil, err
+		}
+
+		infos := []CollectionInfo{}
+
+		for i := 0; i+1 < len(lines); i += 2 {
+			infos = append(infos, CollectionInfo{Name: lines[i], Codec: lines[i+1]})
+		}
+
+		return infos, nil
+	}
+
+	entries, err := os.ReadDir(path.Join(node.config.Directory, namespace))
+
+	if os.IsNotExist(err) {
+		return nil, errors.New("Namespace not found: " + namespace)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+
+	for _, entry := range entries {
+		for _, extension := range []string{".dat", ".wal"} {
+			if strings.HasSuffix(entry.Name(), extension) {
+				names[strings.TrimSuffix(entry.Name(), extension)] = true
+			}
+		}
+	}
+
+	obj, exists := node.namespaces.Load(namespace)
+
+	if exists && obj != nil {
+		obj.(*Namespace).collections.Range(func(key, value interface{}) bool {
+			if value != nil {
+				names[key.(string)] = true
+			}
+
+			return true
+		})
+	}
+
+	infos := []CollectionInfo{}
+
+	for name := range names {
+		infos = append(infos, CollectionInfo{Name: name, Codec: node.collectionCodec(namespace, name)})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// collectionCodec returns the name of the codec of a loaded collection,
+// the codec its files have been written with or the codec it would be created with.
+func (node *Node) collectionCodec(namespace string, name string) string {
+	obj, exists := node.namespaces.Load(namespace)
+
+	if exists && obj != nil {
+		collection, loaded := obj.(*Namespace).collections.Load(name)
+
+		if loaded && collection != nil {
+			return collection.(*Collection).Codec().Name()
+		}
+	}
+
+	for _, extension := range []string{".dat", ".wal"} {
+		codec, err := fileCodecName(path.Join(node.config.Directory, namespace, name+extension))
+
+		if err == nil {
+			return codec
+		}
+	}
+
+	if exists && obj != nil {
+		return obj.(*Namespace).codecFor(name).Name()
+	}
+
+	return JSON().Name()
+}
+
+// requestList asks the server for a list and waits for the answer.
+func (node *Node) requestList(arguments ...string) ([]string, error) {
+	id := atomic.AddUint64(&node.listRequests, 1)
+	response := make(chan *bytes.Buffer, 1)
+	node.listings.Store(id, response)
+	defer node.listings.Delete(id)
+
+	packetData := bytes.Buffer{}
+	fmt.Fprintf(&packetData, "%d\n%s\n", id, strings.Join(arguments, "\n"))
+	node.Client().Stream.Outgoing <- packet.New(packetListRequest, packetData.Bytes())
+
+	timer := time.NewTimer(listTimeout)
+	defer timer.Stop()
+
+	select {
+	case data := <-response:
+		errorMessage := readLine(data)
+
+		if errorMessage != "" {
+			return nil, errors.New(errorMessage)
+		}
+
+		lines := []string{}
+
+		for data.Len() > 0 {
+			lines = append(lines, readLine(data))
+		}
+
+		return lines, nil
+
+	case <-timer.C:
+		return nil, errors.New("Listing " + strings.Join(arguments, " ") + " timed out")
+	}
+}
+
+// serverAnswerListRequest sends the requested list to the client.
+// The first line of the answer contains the error message if the list couldn't be read.
+func serverAnswerListRequest(client *packet.Stream, msg *packet.Packet, node *Node) {
+	data := bytes.NewBuffer(msg.Data)
+	id := readLine(data)
+	lines := []string{}
+	var err error
+
+	switch kind := readLine(data); kind {
+	case "namespaces":
+		lines, err = node.Namespaces()
+
+	case "collections":
+		var infos []CollectionInfo
+		infos, err = node.Collections(readLine(data))
+
+		for _, info := range infos {
+			lines = append(lines, info.Name, info.Codec)
+		}
+
+	default:
+		err = errors.New("Unknown list request: " + kind)
+	}
+
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, "%s\n", id)
+
+	if err != nil {
+		fmt.Fprintf(&buffer, "%s\n", err.Error())
+	} else {
+		fmt.Fprintf(&buffer, "\n")
+	}
+
+	for _, line := range lines {
+		fmt.Fprintf(&buffer, "%s\n", line)
+	}
+
+	client.Outgoing <- packet.New(packetListResponse, buffer.Bytes())
+}
+
+// clientReceiveList passes the answer of a list request to the waiting goroutine.
+func clientReceiveList(msg *packet.Packet, node *Node) {
+	data := bytes.NewBuffer(msg.Data)
+	id, err := strconv.ParseUint(readLine(data), 10, 64)
+
+	if err != nil {
+		fmt.Println("Error reading list response:", err)
+		return
+	}
+
+	obj, waiting := node.listings.Load(id)
+
+	if waiting {
+		obj.(chan *bytes.Buffer) <- data
+	}
+}
@@ -0,0 +1,66 @@
+package nano
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// clockNodeBits is the number of low bits in a timestamp that contain the node ID.
+const clockNodeBits = 16
+
+// clockNodeMask selects the node ID of a timestamp.
+const clockNodeMask = 1<<clockNodeBits - 1
+
+// clock is a hybrid logical clock that creates the timestamps of modifications.
+// Timestamps follow the wall clock in nanoseconds, but they never go backwards
+// and are always newer than every timestamp received from other nodes, so clock skew
+// can't make a modification lose against one that happened before it.
+// The lowest bits contain the ID of the node, therefore two different nodes
+// never create the same timestamp and conflicts are resolved the same way everywhere.
+type clock struct {
+	last int64
+	node int64
+}
+
+// newClock creates a clock with the given node ID or, if it is 0, a random one.
+func newClock(node uint16) *clock {
+	if node == 0 {
+		return &clock{
+			node: 1 + rand.Int63n(clockNodeMask),
+		}
+	}
+
+	return &clock{
+		node: int64(node),
+	}
+}
+
+// now returns a new timestamp that is greater than all timestamps seen before.
+func (clock *clock) now() int64 {
+	for {
+		last := atomic.LoadInt64(&clock.last)
+		next := time.Now().UnixNano() &^ clockNodeMask
+
+		if next <= last&^clockNodeMask {
+			next = last&^clockNodeMask + clockNodeMask + 1
+		}
+
+		next |= clock.node
+
+		if atomic.CompareAndSwapInt64(&clock.last, last, next) {
+			return next
+		}
+	}
+}
+
+// observe moves the clock forward to a timestamp received from another node.
+func (clock *clock) observe(timestamp int64) {
+	for {
+		last := atomic.LoadInt64(&clock.last)
+
+		if timestamp <= last || atomic.CompareAndSwapInt64(&clock.last, last, timestamp) {
+			return
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package nano
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akyoto/assert"
+)
+
+func TestClockTieBreak(t *testing.T) {
+	first := newClock(1)
+	second := newClock(2)
+
+	// Both nodes have seen the same timestamp, so their next timestamps share the time
+	seen := time.Now().Add(time.Hour).UnixNano()
+	first.observe(seen)
+	second.observe(seen)
+
+	firstTime := first.now()
+	secondTime := second.now()
+	assert.Equal(t, firstTime&^clockNodeMask, secondTime&^clockNodeMask)
+	assert.True(t, secondTime > firstTime)
+	assert.Equal(t, int64(1), firstTime&clockNodeMask)
+	assert.Equal(t, int64(2), secondTime&clockNodeMask)
+}
@@ -0,0 +1,44 @@
+package nano_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestCollectionClock(t *testing.T) {
+	const nodeMask = 1<<16 - 1
+
+	clockConfig := config
+	clockConfig.NodeID = 42
+	node := nano.New(clockConfig)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := users.WatchPrefix(ctx, "clock")
+	user := newUser(1)
+
+	for i := 0; i < 100; i++ {
+		users.Set("clock", user)
+	}
+
+	// Timestamps never repeat, even if the wall clock doesn't advance
+	last := (<-changes).Timestamp
+	assert.Equal(t, int64(42), last&nodeMask)
+
+	for i := 1; i < 100; i++ {
+		change := <-changes
+		assert.True(t, change.Timestamp > last)
+		assert.Equal(t, last&nodeMask, change.Timestamp&nodeMask)
+		last = change.Timestamp
+	}
+
+	users.Delete("clock")
+	assert.True(t, (<-changes).Timestamp > last)
+}
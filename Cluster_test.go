@@ -1,6 +1,8 @@
 package nano_test
 
 import (
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -101,6 +103,138 @@ func TestClusterReconnect(t *testing.T) {
 	}
 }
 
+func TestClusterResync(t *testing.T) {
+	server := nano.New(config)
+	client := nano.New(config)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Namespace("test").RegisterTypes(types...).Collection("User")
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+	clientUsers.Set("online", newUser(1))
+
+	for !server.Namespace("test").Exists("User", "online") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Modifications while the server is down
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+	clientUsers.Set("offline", newUser(2))
+	clientUsers.Delete("online")
+
+	// Restart server with its own modification
+	server = nano.New(config)
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+	serverUsers.Set("server", newUser(3))
+
+	start := time.Now()
+
+	for !serverUsers.Exists("offline") || serverUsers.Exists("online") || !clientUsers.Exists("server") {
+		time.Sleep(10 * time.Millisecond)
+
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("Client has not been resynchronized")
+		}
+	}
+
+	assert.Equal(t, serverUsers.Count(), clientUsers.Count())
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
+
+func TestClusterTransfer(t *testing.T) {
+	const userCount = 200
+	reports := make(chan nano.TransferProgress, userCount)
+	clientConfig := config
+	clientConfig.Progress = func(progress nano.TransferProgress) {
+		reports <- progress
+	}
+
+	server := nano.New(config)
+	client := nano.New(clientConfig)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	for i := 0; i < userCount; i++ {
+		serverUsers.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	// The collection is too large for a single chunk
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(userCount), clientUsers.Count())
+
+	chunks := 0
+	progress := <-reports
+
+	for !progress.Done {
+		chunks++
+		progress = <-reports
+	}
+
+	assert.True(t, chunks > 1)
+	assert.Equal(t, "test", progress.Namespace)
+	assert.Equal(t, "User", progress.Collection)
+	assert.True(t, progress.Bytes > userCount*1024)
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
+
+func TestClusterTransferModified(t *testing.T) {
+	const userCount = 200
+	server := nano.New(config)
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	for i := 0; i < userCount; i++ {
+		serverUsers.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	// Modify the collection while the client receives the first chunk
+	modify := sync.Once{}
+	clientConfig := config
+	clientConfig.Progress = func(progress nano.TransferProgress) {
+		modify.Do(func() {
+			serverUsers.Delete("0")
+			serverUsers.Set("new", newUser(userCount))
+		})
+	}
+
+	client := nano.New(clientConfig)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	// Wait until the modifications have been applied
+	time.Sleep(300 * time.Millisecond)
+
+	assert.False(t, clientUsers.Exists("0"))
+	assert.True(t, clientUsers.Exists("new"))
+	assert.Equal(t, int64(userCount), clientUsers.Count())
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
+
 func TestClusterDataSharing(t *testing.T) {
 	// Create cluster where the server has initial data
 	nodes := make([]*nano.Node, nodeCount)
@@ -235,3 +369,50 @@ func TestClusterDelete(t *testing.T) {
 		nodes[i].Close()
 	}
 }
+
+func TestClusterBatch(t *testing.T) {
+	// Create cluster
+	nodes := make([]*nano.Node, nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = nano.New(config)
+		nodes[i].Namespace("test").RegisterTypes(types...)
+	}
+
+	// Wait for clients to connect
+	for nodes[0].Server().ClientCount() < nodeCount-1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Load the collection on all nodes
+	for i := 0; i < nodeCount; i++ {
+		nodes[i].Namespace("test").Collection("User")
+	}
+
+	// Commit a batch on node #1
+	batch := nodes[1].Namespace("test").Collection("User").Batch()
+
+	for i := 0; i < 20; i++ {
+		batch.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	batch.Delete("13")
+	assert.Nil(t, batch.Commit())
+
+	// Wait until it propagates through the whole cluster
+	time.Sleep(300 * time.Millisecond)
+
+	// Confirm that all nodes applied the batch
+	for i := 0; i < nodeCount; i++ {
+		for j := 0; j < 20; j++ {
+			assert.Equal(t, j != 13, nodes[i].Namespace("test").Exists("User", strconv.Itoa(j)))
+		}
+
+		assert.Equal(t, nodes[0].Namespace("test").Collection("User").Count(), nodes[i].Namespace("test").Collection("User").Count())
+	}
+
+	for i := nodeCount - 1; i >= 0; i-- {
+		nodes[i].Clear()
+		nodes[i].Close()
+	}
+}
@@ -0,0 +1,318 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec converts the values of a collection to bytes and back.
+// All nodes of a cluster need to use the same codec for a collection.
+type Codec interface {
+	// Name identifies the codec in the headers of the collection files.
+	Name() string
+
+	// Marshal encodes the value.
+	Marshal(value interface{}) ([]byte, error)
+
+	// Unmarshal decodes the data into the value,
+	// which is a pointer to a new object of the collection type.
+	Unmarshal(data []byte, value interface{}) error
+}
+
+// customCodecs contains the custom codecs that have been used by a collection,
+// so that files written by them can be read again. The codecs are shared by all
+// nodes of the process and the first codec registered under a name is kept,
+// so custom codecs need unique names.
+var customCodecs sync.Map
+
+// legacyHeaderPrefix starts the first line of files in the legacy line format that records their codec.
+// Files without a header have been written by the JSON codec.
+const legacyHeaderPrefix = keyMetadataSeparator + "codec="
+
+// JSON returns the default codec which stores values in JSON format.
+func JSON() Codec {
+	return jsonCodec{}
+}
+
+// MessagePack returns a codec which stores values in MessagePack format.
+func MessagePack() Codec {
+	return msgpackCodec{}
+}
+
+// Gob returns a codec which stores values in the gob format of the Go standard library.
+func Gob() Codec {
+	return gobCodec{}
+}
+
+// Raw returns a codec for collections of []byte values that are stored without any conversion.
+func Raw() Codec {
+	return rawCodec{}
+}
+
+// jsonCodec encodes values as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return jsoniter.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return jsoniter.Unmarshal(data, value)
+}
+
+// msgpackCodec encodes values as MessagePack.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	return msgpack.Unmarshal(data, value)
+}
+
+// gobCodec encodes values with encoding/gob.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	err := gob.NewEncoder(&buffer).Encode(value)
+	return buffer.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// rawCodec passes []byte values through.
+type rawCodec struct{}
+
+func (rawCodec) Name() string { return "raw" }
+
+func (rawCodec) Marshal(value interface{}) ([]byte, error) {
+	switch data := value.(type) {
+	case []byte:
+		return data, nil
+
+	case *[]byte:
+		return *data, nil
+
+	default:
+		return nil, errors.New("The raw codec only supports []byte values")
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, value interface{}) error {
+	target, ok := value.(*[]byte)
+
+	if !ok {
+		return errors.New("The raw codec only supports []byte values")
+	}
+
+	*target = append([]byte(nil), data...)
+	return nil
+}
+
+// codecByName returns the built-in or previously used codec with the given name.
+func codecByName(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return JSON(), nil
+
+	case "msgpack":
+		return MessagePack(), nil
+
+	case "gob":
+		return Gob(), nil
+
+	case "raw":
+		return Raw(), nil
+	}
+
+	codec, exists := customCodecs.Load(name)
+
+	if !exists {
+		return nil, errors.New("Unknown codec: " + name + ", custom codecs need to be set with SetCodec before the collection is loaded")
+	}
+
+	return codec.(Codec), nil
+}
+
+// registerCodec remembers a custom codec by its name.
+func registerCodec(codec Codec) {
+	_, err := codecByName(codec.Name())
+
+	if err != nil {
+		customCodecs.Store(codec.Name(), codec)
+	}
+}
+
+// encodeValue encodes the value for a single line of a network packet or collection transfer.
+// Values of codecs other than JSON can contain line breaks, so they are base64 encoded.
+func encodeValue(codec Codec, value interface{}) ([]byte, error) {
+	data, err := codec.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lineValue(codec, data), nil
+}
+
+// lineValue converts a value serialized with the codec to the format of encodeValue.
+func lineValue(codec Codec, data []byte) []byte {
+	if codec.Name() == "json" {
+		return data
+	}
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(encoded, data)
+	return encoded
+}
+
+// decodeValue is the counterpart of encodeValue.
+func decodeValue(codec Codec, line []byte, value interface{}) error {
+	if codec.Name() == "json" {
+		return codec.Unmarshal(line, value)
+	}
+
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	size, err := base64.StdEncoding.Decode(data, line)
+
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(data[:size], value)
+}
+
+// readLegacyHeader reads the codec from the header line of a file in the legacy line format
+// and returns the size of the header. Files without a header use JSON.
+func readLegacyHeader(reader *bufio.Reader) (Codec, int, error) {
+	name, headerSize, err := readLegacyHeaderCodecName(reader)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	codec, err := codecByName(name)
+	return codec, headerSize, err
+}
+
+// readLegacyHeaderCodecName returns the name of the codec
+// in the header line of a file in the legacy line format.
+func readLegacyHeaderCodecName(reader *bufio.Reader) (string, int, error) {
+	prefix, err := reader.Peek(len(legacyHeaderPrefix))
+
+	if err != nil || string(prefix) != legacyHeaderPrefix {
+		return "json", 0, nil
+	}
+
+	line, err := reader.ReadString('\n')
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	return strings.TrimSuffix(line[len(legacyHeaderPrefix):], "\n"), len(line), nil
+}
+
+// Codec returns the codec used to store the values of the collection.
+func (collection *Collection) Codec() Codec {
+	return *collection.codec.Load()
+}
+
+// SetCodec changes the codec of the collection. Servers rewrite
+// the collection files with the new codec in the background.
+func (collection *Collection) SetCodec(codec Codec) {
+	registerCodec(codec)
+	collection.codec.Store(&codec)
+
+	if !collection.node.IsServer() {
+		return
+	}
+
+	atomic.StoreInt32(&collection.compactRequired, 1)
+
+	if len(collection.dirty) == 0 {
+		collection.dirty <- true
+	}
+}
+
+// encodingError is returned when a value can't be serialized with the codec of the collection.
+type encodingError struct {
+	err error
+}
+
+// Error returns the reason.
+func (err *encodingError) Error() string {
+	return err.err.Error()
+}
+
+// Unwrap returns the reason.
+func (err *encodingError) Unwrap() error {
+	return err.err
+}
+
+// marshal encodes a value with the codec of the collection.
+func (collection *Collection) marshal(value interface{}) ([]byte, error) {
+	data, err := encodeValue(collection.Codec(), value)
+
+	if err != nil {
+		return nil, &encodingError{err: err}
+	}
+
+	return data, nil
+}
+
+// encodedValue is a value serialized with the codec of the collection,
+// so that it can be written to the log without encoding it again.
+type encodedValue struct {
+	codec Codec
+	data  []byte
+}
+
+// encode serializes a value with the codec of the collection.
+func (collection *Collection) encode(value interface{}) (*encodedValue, error) {
+	codec := collection.Codec()
+	data, err := codec.Marshal(value)
+
+	if err != nil {
+		return nil, &encodingError{err: err}
+	}
+
+	return &encodedValue{codec: codec, data: data}, nil
+}
+
+// line returns the value in the format of encodeValue.
+func (encoded *encodedValue) line() []byte {
+	return lineValue(encoded.codec, encoded.data)
+}
+
+// unmarshal decodes a value with the codec of the collection into a new object of the collection type.
+func (collection *Collection) unmarshal(data []byte) (interface{}, error) {
+	return collection.unmarshalWith(collection.Codec(), data)
+}
+
+// unmarshalWith decodes a value with the given codec into a new object of the collection type.
+func (collection *Collection) unmarshalWith(codec Codec, data []byte) (interface{}, error) {
+	obj := reflect.New(collection.typ).Interface()
+	err := decodeValue(codec, data, obj)
+	return obj, err
+}
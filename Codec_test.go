@@ -0,0 +1,126 @@
+package nano_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestCollectionCodecs(t *testing.T) {
+	for _, codec := range []nano.Codec{nano.MessagePack(), nano.Gob()} {
+		node := nano.New(config)
+		users := node.Namespace("test").RegisterTypes(types...).SetCodec(codec, "User").Collection("User")
+		assert.Equal(t, codec.Name(), users.Codec().Name())
+		users.Set("1", newUser(1))
+		node.Close()
+
+		// The codec is read from the file header
+		node = nano.New(config)
+		users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+		user, err := users.Get("1")
+		assert.Nil(t, err)
+		assert.DeepEqual(t, newUser(1), user)
+
+		// The compaction rewrites the files with the default codec
+		users.Clear()
+		users.Set("2", newUser(2))
+		node.Close()
+
+		node = nano.New(config)
+		users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+		user, err = users.Get("2")
+		assert.Nil(t, err)
+		assert.DeepEqual(t, newUser(2), user)
+		node.Clear()
+		node.Close()
+	}
+}
+
+func TestCollectionCodecRaw(t *testing.T) {
+	node := nano.New(config)
+	blobs := node.Namespace("test").RegisterTypeAs("Blob", &[]byte{}).SetCodec(nano.Raw(), "Blob").Collection("Blob")
+	blobs.Set("binary", []byte("line\nbreak\x00"))
+	node.Close()
+
+	node = nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	blobs = node.Namespace("test").RegisterTypeAs("Blob", &[]byte{}).SetCodec(nano.Raw(), "Blob").Collection("Blob")
+	blob, err := blobs.Get("binary")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, []byte("line\nbreak\x00"), *blob.(*[]byte))
+}
+
+func TestCollectionCodecTransfer(t *testing.T) {
+	server := nano.New(config)
+	serverUsers := server.Namespace("test").RegisterTypes(types...).SetCodec(nano.MessagePack(), "User").Collection("User")
+	serverUsers.Set("1", newUser(1))
+
+	// The client switches to the codec of the server
+	client := nano.New(config)
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, "msgpack", clientUsers.Codec().Name())
+
+	user, err := clientUsers.Get("1")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, newUser(1), user)
+
+	clientUsers.Set("2", newUser(2))
+	time.Sleep(300 * time.Millisecond)
+
+	user, err = serverUsers.Get("2")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, newUser(2), user)
+
+	client.Close()
+	server.Clear()
+	server.Close()
+}
+
+// prefixCodec is a custom codec that stores JSON values with a prefix.
+type prefixCodec struct{}
+
+func (prefixCodec) Name() string { return "prefix" }
+
+func (prefixCodec) Marshal(value interface{}) ([]byte, error) {
+	data, err := nano.JSON().Marshal(value)
+	return append([]byte("prefix"), data...), err
+}
+
+func (prefixCodec) Unmarshal(data []byte, value interface{}) error {
+	return nano.JSON().Unmarshal(bytes.TrimPrefix(data, []byte("prefix")), value)
+}
+
+func TestCollectionCodecCustom(t *testing.T) {
+	node := nano.New(config)
+	users := node.Namespace("test").RegisterTypes(types...).SetCodec(prefixCodec{}, "User").Collection("User")
+	users.Set("1", newUser(1))
+	node.Close()
+
+	// The custom codec needs to be set before the collection is loaded
+	node = nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users = node.Namespace("test").RegisterTypes(types...).SetCodec(prefixCodec{}, "User").Collection("User")
+	user, err := users.Get("1")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, newUser(1), user)
+}
+
+func TestCollectionCodecLegacyFile(t *testing.T) {
+	writeLegacySnapshot(t)
+
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	user, err := users.Get("legacy")
+	assert.Nil(t, err)
+	assert.Equal(t, "Legacy", user.(*User).Name)
+}
@@ -3,6 +3,7 @@ package nano
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -16,66 +17,144 @@ import (
 	"time"
 
 	"github.com/aerogo/packet"
-	jsoniter "github.com/json-iterator/go"
 )
 
 // ChannelBufferSize is the size of the channels used to iterate over a whole collection.
 const ChannelBufferSize = 128
 
+// keyLockCount is the number of mutexes that serialize writes to the keys of a collection.
+const keyLockCount = 256
+
+// errNotSwapped is returned internally when CompareAndSwap finds a different value.
+var errNotSwapped = errors.New("Value has been modified")
+
 // Collection is a hash map of data of the same type that is synchronized across network and disk.
 type Collection struct {
 	data             sync.Map
 	lastModification sync.Map
+	pending          sync.Map
+	expires          sync.Map
+	changes          sync.Map
+	tombstones       sync.Map
+	unsynced         sync.Map
+	fetched          sync.Map
 	ns               *Namespace
 	node             *Node
 	name             string
 	dirty            chan bool
 	close            chan bool
 	loaded           chan bool
+	loadError        error
 	count            int64
+	expiring         int64
+	historyStart     int64
+	cleared          int64
+	lastSeen         int64
+	log              *os.File
+	logSize          int64
+	snapshotSize     int64
+	compactRequired  int32
+	lazy             bool
+	legacyFiles      bool
+	recovery         bool
+	corruptRecords   int64
+	durability       atomic.Value
+	codec            atomic.Pointer[Codec]
+	logCodec         Codec
+	keyLocks         [keyLockCount]sync.Mutex
+	watchers         watchers
+	indexes          map[string]*index
+	keys             *orderedKeys
 	fileMutex        sync.Mutex
+	deferred         []*packet.Packet
+	deferring        bool
+	deferredMutex    sync.Mutex
+	compactMutex     sync.Mutex
 	typ              reflect.Type
 }
 
 // newCollection creates a new collection in the namespace with the given name.
-func newCollection(ns *Namespace, name string) *Collection {
+// In recovery mode, servers skip damaged records of the collection files.
+func newCollection(ns *Namespace, name string, recovery bool) (*Collection, error) {
 	collection := &Collection{
-		ns:     ns,
-		node:   ns.node,
-		name:   name,
-		dirty:  make(chan bool, runtime.NumCPU()),
-		close:  make(chan bool),
-		loaded: make(chan bool),
+		ns:       ns,
+		node:     ns.node,
+		name:     name,
+		dirty:    make(chan bool, runtime.NumCPU()),
+		close:    make(chan bool),
+		loaded:   make(chan bool),
+		keys:     newOrderedKeys(),
+		lazy:     ns.node.config.Lazy && !ns.node.IsServer(),
+		recovery: recovery && ns.node.IsServer(),
 	}
 
+	collection.durability.Store(ns.node.config.Durability)
+	codec := ns.codecFor(name)
+	collection.codec.Store(&codec)
+
 	t, exists := collection.ns.types.Load(collection.name)
 
 	if !exists {
-		panic("Type " + collection.name + " has not been defined")
+		return nil, errors.New("Type " + collection.name + " has not been defined")
 	}
 
 	collection.typ = t.(reflect.Type)
-	collection.load()
+	indexes, err := newIndexes(collection.typ)
+
+	if err != nil {
+		return nil, err
+	}
 
-	return collection
+	collection.indexes = indexes
+	err = collection.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return collection, nil
 }
 
 // load loads all collection data
-func (collection *Collection) load() {
+func (collection *Collection) load() error {
 	if collection.node.IsServer() {
 		// Server loads the collection from disk
 		err := collection.loadFromDisk()
 
 		if err != nil {
-			panic(err)
+			closeErr := collection.closeLog()
+
+			if closeErr != nil {
+				fmt.Println("Error closing collection", collection.name, closeErr)
+			}
+
+			return err
+		}
+
+		// Modifications before the start of the history are unknown
+		if collection.historyStart == 0 {
+			collection.historyStart = time.Now().UnixNano()
+		}
+
+		// Damaged records have been moved to the .corrupt file,
+		// so the next compaction can remove them from the collection files
+		if collection.corruptRecords > 0 {
+			collection.compactRequired = 1
+			collection.dirty <- true
 		}
 
 		// Indicate that collection is loaded
 		close(collection.loaded)
 
 		go func() {
+			reaper := time.NewTicker(reapInterval)
+			defer reaper.Stop()
+
 			for {
 				select {
+				case <-reaper.C:
+					collection.reap()
+
 				case <-collection.dirty:
 					for len(collection.dirty) > 0 {
 						<-collection.dirty
@@ -87,15 +166,19 @@ func (collection *Collection) load() {
 						fmt.Println("Error writing collection", collection.name, "to disk", err)
 					}
 
-					time.Sleep(collection.node.ioSleepTime)
+					time.Sleep(collection.flushInterval())
 
 				case <-collection.close:
-					if len(collection.dirty) > 0 {
-						err := collection.flush()
+					err := collection.flush()
 
-						if err != nil {
-							fmt.Println("Error writing collection", collection.name, "to disk", err)
-						}
+					if err != nil {
+						fmt.Println("Error writing collection", collection.name, "to disk", err)
+					}
+
+					err = collection.closeLog()
+
+					if err != nil {
+						fmt.Println("Error closing collection", collection.name, err)
 					}
 
 					close(collection.close)
@@ -103,21 +186,33 @@ func (collection *Collection) load() {
 				}
 			}
 		}()
+	} else if collection.lazy {
+		// Lazy clients fetch the keys when they are read
+		close(collection.loaded)
 	} else {
-		// Client asks the server to send the most recent collection data
+		// Client asks the server to send the most recent collection data.
+		// Modifications received in the meantime are kept until the data has arrived.
+		collection.deferring = true
 		collection.ns.collectionsLoading.Store(collection.name, collection)
-		packetData := bytes.Buffer{}
-		fmt.Fprintf(&packetData, "%s\n%s\n", collection.ns.name, collection.name)
-		collection.node.Client().Stream.Outgoing <- packet.New(packetCollectionRequest, packetData.Bytes())
+		collection.request(0)
 		<-collection.loaded
+		return collection.loadError
 	}
+
+	return nil
 }
 
 // Get returns the value for the given key.
+// Expired keys are treated as missing.
+// Lazy clients fetch unknown keys from the server.
 func (collection *Collection) Get(key string) (interface{}, error) {
-	val, ok := collection.data.Load(key)
+	val, ok, err := collection.lookup(key)
 
-	if !ok {
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok || collection.isExpired(key) {
 		return val, errors.New("Key not found: " + key)
 	}
 
@@ -136,112 +231,478 @@ func (collection *Collection) GetMany(keys []string) []interface{} {
 }
 
 // set is the internally used function to store a value for a key.
-func (collection *Collection) set(key string, value interface{}) {
-	collection.data.Store(key, value)
-
-	if collection.node.IsServer() && len(collection.dirty) == 0 {
-		collection.dirty <- true
-	}
+// The caller must hold the key lock.
+func (collection *Collection) set(key string, value interface{}, expiresAt int64, timestamp int64, origin Origin) error {
+	collection.apply(key, value, expiresAt, timestamp, origin)
+	return collection.markDirty(key, nil)
 }
 
 // Set sets the value for the key.
+// It panics if the value can not be serialized and prints errors writing to disk,
+// use SetE to handle the errors instead.
 func (collection *Collection) Set(key string, value interface{}) {
-	if value == nil {
+	collection.reportSetError(collection.SetE(key, value))
+}
+
+// reportSetError panics if the value could not be serialized
+// and prints errors writing to disk.
+func (collection *Collection) reportSetError(err error) {
+	if err == nil {
 		return
 	}
 
-	if collection.node.broadcastRequired() {
-		// It's important to store the timestamp BEFORE the actual collection.set
-		collection.lastModification.Store(key, time.Now().UnixNano())
+	var encodingErr *encodingError
+
+	if errors.As(err, &encodingErr) {
+		panic(err)
+	}
 
-		// Serialize the value into JSON format
-		jsonBytes, err := jsoniter.Marshal(value)
+	fmt.Println("Error writing collection", collection.name, "to disk", err)
+}
 
-		if err != nil {
-			panic(err)
-		}
+// SetE sets the value for the key. It returns an error if the value can not be
+// serialized and if the value can not be written to disk in sync mode.
+func (collection *Collection) SetE(key string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	lock := collection.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return collection.setAndBroadcast(key, value, 0)
+}
+
+// setAndBroadcast stores the value locally and notifies the other nodes.
+// An expiration time of 0 means that the key doesn't expire.
+// The caller must hold the key lock.
+func (collection *Collection) setAndBroadcast(key string, value interface{}, expiresAt int64) error {
+	now := collection.node.clock.now()
+	broadcast := collection.node.broadcastRequired()
+	sent := false
 
-		// Create a network packet for the "set" command
-		buffer := bytes.Buffer{}
-		buffer.Write(packet.Int64ToBytes(time.Now().UnixNano()))
-		buffer.WriteString(collection.ns.name)
-		buffer.WriteByte('\n')
-		buffer.WriteString(collection.name)
-		buffer.WriteByte('\n')
-		buffer.WriteString(key)
-		buffer.WriteByte('\n')
-		buffer.Write(jsonBytes)
-		buffer.WriteByte('\n')
+	// Values that can't be serialized are rejected before they are stored.
+	// The serialized value is reused by the network packet and the log.
+	encoded, err := collection.encode(value)
 
-		msg := packet.New(packetSet, buffer.Bytes())
-		collection.node.Broadcast(msg)
+	if err != nil {
+		return err
+	}
+
+	if broadcast {
+		sent = collection.broadcastSet(key, expiresAt, encoded.line(), now)
+	}
+
+	if !sent {
+		collection.markUnsynced(key, now)
 	}
 
-	collection.set(key, value)
+	collection.apply(key, value, expiresAt, now, OriginLocal)
+	return collection.markDirty(key, encoded)
+}
+
+// broadcastSet sends the new value of the key to the other nodes
+// and reports whether the packet could be sent.
+func (collection *Collection) broadcastSet(key string, expiresAt int64, encoded []byte, now int64) bool {
+	// It's important to store the timestamp BEFORE the actual collection.set
+	collection.lastModification.Store(key, now)
+
+	// Create a network packet for the "set" command
+	buffer := bytes.Buffer{}
+	buffer.Write(packet.Int64ToBytes(now))
+	buffer.WriteString(collection.ns.name)
+	buffer.WriteByte('\n')
+	buffer.WriteString(collection.name)
+	buffer.WriteByte('\n')
+	buffer.WriteString(keyLine(key, keyMetadata{expiresAt: expiresAt}))
+	buffer.WriteByte('\n')
+	buffer.Write(encoded)
+	buffer.WriteByte('\n')
+
+	msg := packet.New(packetSet, buffer.Bytes())
+	return collection.node.broadcast(msg)
 }
 
 // delete is the internally used command to delete a key.
-func (collection *Collection) delete(key string) {
-	collection.data.Delete(key)
+// The caller must hold the key lock.
+func (collection *Collection) delete(key string, timestamp int64, origin Origin) error {
+	collection.apply(key, nil, 0, timestamp, origin)
+	return collection.markDirty(key, nil)
+}
+
+// apply performs a single modification of the data and notifies watchers.
+// A nil value deletes the key. The caller must hold the key lock
+// and is responsible for persisting the modification.
+func (collection *Collection) apply(key string, value interface{}, expiresAt int64, timestamp int64, origin Origin) {
+	old, existed := collection.data.Load(key)
+
+	// Servers remember the time of every modification for the resynchronization of clients
+	if timestamp != 0 && collection.node.IsServer() {
+		collection.changes.Store(key, time.Now().UnixNano())
+	}
+
+	if value == nil {
+		// Servers remember deleted keys, so that older modifications can't restore them
+		if timestamp != 0 && collection.node.IsServer() {
+			collection.tombstones.Store(key, timestamp)
+		}
+
+		if !existed {
+			return
+		}
+
+		collection.data.Delete(key)
+		collection.storeExpiration(key, 0)
+		collection.keys.remove(key)
+		atomic.AddInt64(&collection.count, -1)
+		collection.updateIndexes(key, nil)
+
+		collection.notify(Change{
+			Operation: OperationDelete,
+			Key:       key,
+			Old:       old,
+			Origin:    origin,
+			Timestamp: timestamp,
+		})
+
+		return
+	}
+
+	if collection.node.IsServer() {
+		collection.tombstones.Delete(key)
+	}
+
+	// The expiration time is stored first so that readers never see the new value without it
+	collection.storeExpiration(key, expiresAt)
+	collection.data.Store(key, value)
+
+	if !existed {
+		collection.keys.insert(key)
+		atomic.AddInt64(&collection.count, 1)
+	}
+
+	collection.updateIndexes(key, value)
+
+	collection.notify(Change{
+		Operation: OperationSet,
+		Key:       key,
+		Old:       old,
+		New:       value,
+		Origin:    origin,
+		Timestamp: timestamp,
+	})
+}
+
+// markDirty remembers the key for the next write to the log
+// and notifies the writer goroutine. In sync mode, the log
+// is written before markDirty returns. Unless the encoded value is nil,
+// it is written to the log instead of encoding the value again.
+func (collection *Collection) markDirty(key string, encoded *encodedValue) error {
+	if !collection.node.IsServer() {
+		return nil
+	}
+
+	collection.pending.Store(key, encoded)
+	return collection.persist()
+}
+
+// persist writes the pending keys to the log in sync mode
+// and notifies the writer goroutine.
+func (collection *Collection) persist() error {
+	var err error
+
+	if collection.isSync() {
+		collection.fileMutex.Lock()
+		err = collection.appendLog()
+		collection.fileMutex.Unlock()
+
+		if err != nil {
+			atomic.StoreInt32(&collection.compactRequired, 1)
+		}
+	}
 
-	if collection.node.IsServer() && len(collection.dirty) == 0 {
+	// The writer goroutine also takes care of log compaction
+	if len(collection.dirty) == 0 {
 		collection.dirty <- true
 	}
+
+	return err
 }
 
 // Delete deletes a key from the collection.
 func (collection *Collection) Delete(key string) bool {
+	exists, err := collection.DeleteE(key)
+
+	if err != nil {
+		fmt.Println("Error writing collection", collection.name, "to disk", err)
+	}
+
+	return exists
+}
+
+// DeleteE deletes a key from the collection and reports whether it existed.
+// It returns an error if the deletion could not be written to disk in sync mode.
+func (collection *Collection) DeleteE(key string) (bool, error) {
+	// Lazy clients need to know whether the key exists before the lock is taken,
+	// otherwise the response of the server would wait for the lock
+	_, _, err := collection.lookup(key)
+
+	if err != nil {
+		return false, err
+	}
+
+	lock := collection.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return collection.Exists(key), collection.deleteAndBroadcast(key)
+}
+
+// deleteAndBroadcast deletes the key locally and notifies the other nodes.
+// The caller must hold the key lock.
+func (collection *Collection) deleteAndBroadcast(key string) error {
+	now := collection.node.clock.now()
+	sent := false
+
 	if collection.node.broadcastRequired() {
-		// It's important to store the timestamp BEFORE the actual collection.delete
-		collection.lastModification.Store(key, time.Now().UnixNano())
+		sent = collection.broadcastDelete(key, now)
+	}
 
-		buffer := bytes.Buffer{}
-		buffer.Write(packet.Int64ToBytes(time.Now().UnixNano()))
-		buffer.WriteString(collection.ns.name)
-		buffer.WriteByte('\n')
-		buffer.WriteString(collection.name)
-		buffer.WriteByte('\n')
-		buffer.WriteString(key)
-		buffer.WriteByte('\n')
+	if !sent {
+		collection.markUnsynced(key, now)
+	}
 
-		msg := packet.New(packetDelete, buffer.Bytes())
-		collection.node.Broadcast(msg)
+	return collection.delete(key, now, OriginLocal)
+}
+
+// broadcastDelete sends the deletion of the key to the other nodes
+// and reports whether the packet could be sent.
+func (collection *Collection) broadcastDelete(key string, now int64) bool {
+	// It's important to store the timestamp BEFORE the actual collection.delete
+	collection.lastModification.Store(key, now)
+
+	buffer := bytes.Buffer{}
+	buffer.Write(packet.Int64ToBytes(now))
+	buffer.WriteString(collection.ns.name)
+	buffer.WriteByte('\n')
+	buffer.WriteString(collection.name)
+	buffer.WriteByte('\n')
+	buffer.WriteString(keyEscaper.Replace(key))
+	buffer.WriteByte('\n')
+
+	msg := packet.New(packetDelete, buffer.Bytes())
+	return collection.node.broadcast(msg)
+}
+
+// restore stores a value that has been read from disk or received in a collection transfer.
+// A nil value or an expiration time in the past deletes the key.
+// Tombstones keep blocking older modifications of the deleted key.
+func (collection *Collection) restore(key string, value interface{}, metadata keyMetadata) {
+	if metadata.cleared != 0 {
+		collection.storeCleared(metadata.cleared)
+		return
+	}
+
+	if metadata.expiresAt != 0 && metadata.expiresAt <= time.Now().UnixNano() {
+		value = nil
 	}
 
-	_, exists := collection.data.Load(key)
-	collection.delete(key)
+	lock := collection.keyLock(key)
+	lock.Lock()
+	collection.apply(key, value, metadata.expiresAt, 0, OriginLocal)
 
-	return exists
+	if metadata.changed != 0 {
+		collection.changes.Store(key, metadata.changed)
+	}
+
+	if value == nil && metadata.deleted != 0 {
+		collection.storeTombstone(key, metadata.deleted)
+	}
+
+	lock.Unlock()
+}
+
+// Update atomically replaces the value for the key with the result of the update function.
+// The function receives the current value or nil if the key doesn't exist.
+// If it returns an error, the collection stays unmodified and Update returns the error.
+// If it returns a nil value, the key is deleted.
+// The expiration time of the key is kept.
+// Other writes to the same key are blocked while the function runs,
+// therefore it should not access the same collection.
+func (collection *Collection) Update(key string, update func(old interface{}) (interface{}, error)) error {
+	// Lazy clients need to know the current value
+	_, _, err := collection.lookup(key)
+
+	if err != nil {
+		return err
+	}
+
+	lock := collection.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old, _ := collection.data.Load(key)
+	expiresAt := collection.expiresAt(key)
+
+	if collection.isExpired(key) {
+		old = nil
+		expiresAt = 0
+	}
+
+	value, err := update(old)
+
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		if old == nil {
+			return nil
+		}
+
+		return collection.deleteAndBroadcast(key)
+	}
+
+	return collection.setAndBroadcast(key, value, expiresAt)
+}
+
+// CompareAndSwap sets the value for the key to newValue only if the current value is oldValue
+// and reports whether the swap happened. The values are compared by identity,
+// so oldValue should be the value previously returned by Get. A nil oldValue
+// means that the key must not exist and a nil newValue deletes the key.
+func (collection *Collection) CompareAndSwap(key string, oldValue interface{}, newValue interface{}) bool {
+	swapped := false
+
+	err := collection.Update(key, func(current interface{}) (interface{}, error) {
+		if !sameValue(current, oldValue) {
+			return current, errNotSwapped
+		}
+
+		swapped = true
+		return newValue, nil
+	})
+
+	if err != nil && err != errNotSwapped {
+		fmt.Println("Error writing collection", collection.name, "to disk", err)
+	}
+
+	return swapped
+}
+
+// keyLock returns the mutex responsible for writes to the given key.
+func (collection *Collection) keyLock(key string) *sync.Mutex {
+	return &collection.keyLocks[keyLockIndex(key)]
+}
+
+// keyLockIndex returns the index of the key lock for the given key.
+func keyLockIndex(key string) int {
+	// FNV-1a
+	hash := uint32(2166136261)
+
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return int(hash % keyLockCount)
+}
+
+// sameValue reports whether both values are identical.
+func sameValue(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+
+	return a == b
+}
+
+// Durability returns the durability settings of the collection.
+func (collection *Collection) Durability() Durability {
+	return collection.durability.Load().(Durability)
+}
+
+// SetDurability changes when modifications of the collection are written to disk.
+func (collection *Collection) SetDurability(durability Durability) {
+	collection.durability.Store(durability)
+}
+
+// isSync reports whether modifications are written to disk before they return.
+func (collection *Collection) isSync() bool {
+	return collection.node.IsServer() && collection.Durability().Mode == DurabilitySync
+}
+
+// flushInterval returns the minimum time between two log writes of the writer goroutine.
+func (collection *Collection) flushInterval() time.Duration {
+	durability := collection.Durability()
+
+	if durability.Mode == DurabilityInterval && durability.Interval > 0 {
+		return durability.Interval
+	}
+
+	return collection.node.ioSleepTime
 }
 
 // Clear deletes all objects from the collection.
+// Instead of a tombstone for every key, the collection remembers the time of the Clear
+// and rejects all modifications that are older.
 func (collection *Collection) Clear() {
+	now := collection.node.clock.now()
+	collection.storeCleared(now)
+
+	// Clients that have seen modifications before the Clear need a full transfer
+	collection.advanceHistory(time.Now().UnixNano())
+
 	collection.data.Range(func(key, value interface{}) bool {
-		collection.data.Delete(key)
+		lock := collection.keyLock(key.(string))
+		lock.Lock()
+		collection.apply(key.(string), nil, 0, now, OriginLocal)
+		collection.forget(key.(string), now)
+		lock.Unlock()
 		return true
 	})
 
+	for _, timestamps := range []*sync.Map{&collection.tombstones, &collection.lastModification} {
+		timestamps.Range(func(key, _ interface{}) bool {
+			lock := collection.keyLock(key.(string))
+			lock.Lock()
+			collection.forget(key.(string), now)
+			lock.Unlock()
+			return true
+		})
+	}
+
 	runtime.GC()
+	atomic.StoreInt32(&collection.compactRequired, 1)
 
 	if len(collection.dirty) == 0 {
 		collection.dirty <- true
 	}
-
-	atomic.StoreInt64(&collection.count, 0)
 }
 
 // Exists returns whether or not the key exists.
+// Expired keys don't exist.
 func (collection *Collection) Exists(key string) bool {
-	_, exists := collection.data.Load(key)
-	return exists
+	_, exists, err := collection.lookup(key)
+	return err == nil && exists && !collection.isExpired(key)
 }
 
 // All returns a channel of all objects in the collection.
+// The channel must be read until it is closed, otherwise the goroutine
+// filling it will leak. Use AllContext or ForEach if you need to stop early.
 func (collection *Collection) All() chan interface{} {
 	channel := make(chan interface{}, ChannelBufferSize)
 
 	go func() {
 		collection.data.Range(func(key, value interface{}) bool {
+			if collection.isExpired(key.(string)) {
+				return true
+			}
+
 			channel <- value
 			return true
 		})
@@ -252,22 +713,61 @@ func (collection *Collection) All() chan interface{} {
 	return channel
 }
 
-// Count gives you a rough estimate of how many elements are in the collection.
-// It DOES NOT GUARANTEE that the returned number is the actual number of elements.
-// A good use for this function is to preallocate slices with the given capacity.
-// In the future, this function could possibly return the exact number of elements.
+// AllContext returns a channel of all key/value pairs in the collection.
+// The channel is closed after the last pair or when the context is cancelled,
+// so consumers can stop reading early by cancelling the context.
+func (collection *Collection) AllContext(ctx context.Context) <-chan KeyValue {
+	channel := make(chan KeyValue, ChannelBufferSize)
+
+	go func() {
+		defer close(channel)
+
+		collection.data.Range(func(key, value interface{}) bool {
+			if collection.isExpired(key.(string)) {
+				return true
+			}
+
+			select {
+			case channel <- KeyValue{Key: key.(string), Value: value}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return channel
+}
+
+// ForEach calls the function for every key/value pair in the collection.
+// Iteration stops as soon as the function returns false.
+func (collection *Collection) ForEach(callback func(key string, value interface{}) bool) {
+	collection.data.Range(func(key, value interface{}) bool {
+		if collection.isExpired(key.(string)) {
+			return true
+		}
+
+		return callback(key.(string), value)
+	})
+}
+
+// Count returns the number of elements in the collection.
+// Expired keys are counted until they have been deleted.
+// Lazy clients only count the keys they know.
 func (collection *Collection) Count() int64 {
 	return atomic.LoadInt64(&collection.count)
 }
 
-// flush writes all data to the file system.
-func (collection *Collection) flush() error {
-	collection.fileMutex.Lock()
-	defer collection.fileMutex.Unlock()
+// filePath returns the path of the collection file with the given extension.
+func (collection *Collection) filePath(extension string) string {
+	return path.Join(collection.ns.root, collection.name+extension)
+}
 
-	newFilePath := path.Join(collection.ns.root, collection.name+".new")
-	oldFilePath := path.Join(collection.ns.root, collection.name+".dat")
-	tmpFilePath := path.Join(collection.ns.root, collection.name+".tmp")
+// writeSnapshot writes all data to the file system.
+func (collection *Collection) writeSnapshot() error {
+	newFilePath := collection.filePath(".new")
+	oldFilePath := collection.filePath(".dat")
+	tmpFilePath := collection.filePath(".tmp")
 
 	file, err := os.OpenFile(newFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 
@@ -275,8 +775,15 @@ func (collection *Collection) flush() error {
 		return err
 	}
 
+	codec := collection.Codec()
 	bufferedWriter := bufio.NewWriter(file)
-	err = collection.writeRecords(bufferedWriter, true)
+	err = writeFileHeader(bufferedWriter, codec)
+
+	if err != nil {
+		return err
+	}
+
+	err = collection.writeSnapshotRecords(bufferedWriter, codec, collection.records(true, false))
 
 	if err != nil {
 		return err
@@ -294,6 +801,13 @@ func (collection *Collection) flush() error {
 		return err
 	}
 
+	stat, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&collection.snapshotSize, stat.Size())
 	err = file.Close()
 
 	if err != nil {
@@ -313,6 +827,13 @@ func (collection *Collection) flush() error {
 		return err
 	}
 
+	// The new snapshot must survive a crash before the old one is removed
+	err = syncDirectory(collection.ns.root)
+
+	if err != nil {
+		return err
+	}
+
 	err = os.Remove(tmpFilePath)
 
 	if err != nil && !os.IsNotExist(err) {
@@ -322,35 +843,26 @@ func (collection *Collection) flush() error {
 	return nil
 }
 
-// writeRecords writes the entire collection to the IO writer.
-func (collection *Collection) writeRecords(writer io.Writer, sorted bool) error {
-	records := []keyValue{}
+// writeRecords writes the entire collection including the tombstones to the IO writer.
+// Collection transfers also include the modification time of every key.
+func (collection *Collection) writeRecords(writer io.Writer, codec Codec, sorted bool, transfer bool) error {
 	stringWriter, ok := writer.(io.StringWriter)
 
 	if !ok {
 		return errors.New("The given io.Writer is not an io.StringWriter")
 	}
 
-	collection.data.Range(func(key, value interface{}) bool {
-		records = append(records, keyValue{
-			key:   key.(string),
-			value: value,
-		})
-		return true
-	})
+	for _, record := range collection.records(sorted, transfer) {
+		encoded, err := encodeValue(codec, record.Value)
 
-	if sorted {
-		sort.Slice(records, func(i, j int) bool {
-			return records[i].key < records[j].key
-		})
-	}
-
-	atomic.StoreInt64(&collection.count, int64(len(records)))
-	encoder := jsoniter.NewEncoder(writer)
+		if err != nil {
+			// Skip the record instead of losing the whole file
+			fmt.Println("Error encoding key", record.Key, "of collection", collection.name, err)
+			continue
+		}
 
-	for _, record := range records {
 		// Key in the first line
-		_, err := stringWriter.WriteString(record.key)
+		_, err = stringWriter.WriteString(keyLine(record.Key, record.metadata))
 
 		if err != nil {
 			return err
@@ -363,7 +875,13 @@ func (collection *Collection) writeRecords(writer io.Writer, sorted bool) error
 		}
 
 		// Value in the second line
-		err = encoder.Encode(record.value)
+		_, err = writer.Write(encoded)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = stringWriter.WriteString("\n")
 
 		if err != nil {
 			return err
@@ -373,10 +891,125 @@ func (collection *Collection) writeRecords(writer io.Writer, sorted bool) error
 	return nil
 }
 
-// loadFromDisk loads the entire collection from disk.
+// records returns all keys of the collection including the tombstones.
+// Collection transfers also include the modification time of every key.
+func (collection *Collection) records(sorted bool, transfer bool) []keyRecord {
+	records := []keyRecord{}
+
+	collection.data.Range(func(key, value interface{}) bool {
+		if collection.isExpired(key.(string)) {
+			return true
+		}
+
+		record := keyRecord{
+			KeyValue: KeyValue{
+				Key:   key.(string),
+				Value: value,
+			},
+			metadata: keyMetadata{
+				expiresAt: collection.expiresAt(key.(string)),
+			},
+		}
+
+		if transfer {
+			record.metadata.modified = collection.modificationTime(key.(string))
+		}
+
+		records = append(records, record)
+
+		return true
+	})
+
+	// Deleted keys are stored with a null value
+	collection.tombstones.Range(func(key, deleted interface{}) bool {
+		_, exists := collection.data.Load(key)
+
+		if exists {
+			return true
+		}
+
+		record := keyRecord{
+			KeyValue: KeyValue{
+				Key: key.(string),
+			},
+			metadata: keyMetadata{
+				deleted: deleted.(int64),
+			},
+		}
+
+		if transfer {
+			record.metadata.modified = deleted.(int64)
+		}
+
+		records = append(records, record)
+		return true
+	})
+
+	if sorted {
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].Key < records[j].Key
+		})
+	}
+
+	return records
+}
+
+// loadFromDisk loads the latest snapshot from disk
+// and replays the write-ahead log on top of it.
 func (collection *Collection) loadFromDisk() error {
-	filePath := path.Join(collection.ns.root, collection.name+".dat")
-	stream, err := os.OpenFile(filePath, os.O_RDONLY|os.O_SYNC, 0644)
+	err := collection.recoverSnapshot()
+
+	if err != nil {
+		return err
+	}
+
+	err = collection.loadSnapshot()
+
+	if err != nil {
+		return err
+	}
+
+	err = collection.replayLog(".wal.old")
+
+	if err != nil {
+		return err
+	}
+
+	err = collection.replayLog(".wal")
+
+	if err != nil {
+		return err
+	}
+
+	if collection.legacyFiles {
+		err = collection.replaceLegacyFiles()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	collection.fileMutex.Lock()
+	err = collection.openLog()
+	collection.fileMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Finish a compaction that was interrupted
+	_, err = os.Stat(collection.filePath(".wal.old"))
+
+	if err == nil {
+		return collection.compact()
+	}
+
+	return nil
+}
+
+// loadSnapshot loads the .dat file.
+func (collection *Collection) loadSnapshot() error {
+	stream, err := os.OpenFile(collection.filePath(".dat"), os.O_RDONLY|os.O_SYNC, 0644)
 
 	if os.IsNotExist(err) {
 		return nil
@@ -386,21 +1019,49 @@ func (collection *Collection) loadFromDisk() error {
 		return err
 	}
 
-	return collection.readRecords(stream)
+	defer stream.Close()
+	stat, err := stream.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	collection.snapshotSize = stat.Size()
+
+	reader := bufio.NewReader(stream)
+
+	if hasFileHeader(reader) {
+		return collection.readSnapshotRecords(stream, reader, collection.restore)
+	}
+
+	// Snapshots in the legacy line format are replaced after loading
+	collection.legacyFiles = stat.Size() > 0
+	codec, _, err := readLegacyHeader(reader)
+
+	if err != nil {
+		return err
+	}
+
+	return collection.forEachRecord(reader, codec, parseLegacyKeyLine, collection.restore)
 }
 
 // readRecords reads the entire collection from an IO reader.
 func (collection *Collection) readRecords(stream io.Reader) error {
+	return collection.forEachRecord(stream, collection.Codec(), parseKeyLine, collection.restore)
+}
+
+// forEachRecord decodes all records in the format of writeRecords
+// and calls the function for each one of them.
+// The key lines are split with parseKeyLine or, in legacy snapshots, with parseLegacyKeyLine.
+func (collection *Collection) forEachRecord(stream io.Reader, codec Codec, parse func(string) (string, keyMetadata, error), callback func(key string, value interface{}, metadata keyMetadata)) error {
 	var key string
-	var value []byte
+	var keyBytes []byte
+	var metadata keyMetadata
+	var keyErr error
 
 	reader := bufio.NewReader(stream)
 	lineCount := 0
 
-	defer func() {
-		atomic.StoreInt64(&collection.count, int64(lineCount/2))
-	}()
-
 	for {
 		line, err := reader.ReadBytes('\n')
 
@@ -418,18 +1079,28 @@ func (collection *Collection) readRecords(stream io.Reader) error {
 		}
 
 		if lineCount%2 == 0 {
-			key = string(line)
-		} else {
-			value = line
-			v := reflect.New(collection.typ)
-			obj := v.Interface()
-			err = jsoniter.Unmarshal(value, &obj)
+			keyBytes = line
+			key, metadata, keyErr = parse(string(line))
+		} else if keyErr != nil {
+			err = collection.skipDamaged(keyBytes, nil, line, keyErr)
 
 			if err != nil {
 				return err
 			}
+		} else if metadata.deleted != 0 {
+			callback(key, nil, metadata)
+		} else {
+			obj, err := collection.unmarshalWith(codec, line)
+
+			if err != nil {
+				err = collection.skipDamaged(keyBytes, nil, line, err)
 
-			collection.data.Store(key, obj)
+				if err != nil {
+					return err
+				}
+			} else {
+				callback(key, obj, metadata)
+			}
 		}
 
 		lineCount++
@@ -0,0 +1,324 @@
+package nano_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerogo/flow"
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestCollectionColdStart(t *testing.T) {
+	node := nano.New(config)
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Clear()
+
+	// Enough records to trigger a compaction of the log
+	recordCount := 3000
+
+	for i := 0; i < recordCount; i++ {
+		users.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	users.Delete("42")
+	node.Close()
+
+	// Cold start
+	node = nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	for i := 0; i < recordCount; i++ {
+		assert.Equal(t, i != 42, users.Exists(strconv.Itoa(i)))
+	}
+}
+
+func TestCollectionSyncDurability(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.SetDurability(nano.Sync())
+	assert.Equal(t, nano.DurabilitySync, users.Durability().Mode)
+
+	users.Set("durable", newUser(1))
+
+	// The record must be in the log as soon as Set returns
+	logData, err := ioutil.ReadFile(path.Join(namespaceDirectory("test"), "User.wal"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(logData), "+durable"))
+	assert.True(t, strings.Contains(string(logData), "changed="))
+}
+
+func TestCollectionUpdate(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Set("counter", newUser(0))
+
+	flow.ParallelRepeat(100, func() {
+		err := users.Update("counter", func(old interface{}) (interface{}, error) {
+			user := *old.(*User)
+			user.BirthYear += "x"
+			return &user, nil
+		})
+
+		assert.Nil(t, err)
+	})
+
+	obj, err := users.Get("counter")
+	assert.Nil(t, err)
+	assert.Equal(t, 4+100, len(obj.(*User).BirthYear))
+
+	// Returning nil deletes the key
+	err = users.Update("counter", func(old interface{}) (interface{}, error) {
+		return nil, nil
+	})
+
+	assert.Nil(t, err)
+	assert.False(t, users.Exists("counter"))
+}
+
+func TestCollectionCompareAndSwap(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Delete("cas")
+
+	first := newUser(1)
+	second := newUser(2)
+
+	assert.True(t, users.CompareAndSwap("cas", nil, first))
+	assert.False(t, users.CompareAndSwap("cas", nil, second))
+	assert.False(t, users.CompareAndSwap("cas", second, second))
+	assert.True(t, users.CompareAndSwap("cas", first, second))
+
+	obj, err := users.Get("cas")
+	assert.Nil(t, err)
+	assert.Equal(t, second, obj)
+}
+
+func TestCollectionBatch(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Set("3", newUser(3))
+
+	batch := users.Batch().
+		Set("1", newUser(1)).
+		Set("2", newUser(2)).
+		Delete("3")
+
+	assert.Equal(t, 3, batch.Len())
+	assert.Nil(t, batch.Commit())
+
+	assert.True(t, users.Exists("1"))
+	assert.True(t, users.Exists("2"))
+	assert.False(t, users.Exists("3"))
+}
+
+func TestCollectionSpecialKeys(t *testing.T) {
+	server := nano.New(config)
+	client := nano.New(config)
+	users := server.Namespace("test").RegisterTypes(types...).Collection("User")
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	// Keys may contain the characters that separate lines and metadata
+	keys := []string{"a\nb", "a\x00changed=1", "a\\nb", "\\0", "\x00", ""}
+
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, key := range keys[:3] {
+		users.Set(key, newUser(i))
+	}
+
+	assert.Nil(t, users.Compact())
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !clientUsers.Exists(keys[0]) {
+		assert.True(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Nil(t, clientUsers.Batch().Set(keys[3], newUser(3)).Set(keys[4], newUser(4)).Commit())
+	clientUsers.SetWithTTL(keys[5], newUser(5), time.Hour)
+	assert.True(t, clientUsers.Delete(keys[0]))
+
+	for users.Exists(keys[0]) || !users.Exists(keys[5]) {
+		assert.True(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, key := range keys[1:] {
+		user, err := clientUsers.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(i+1), user.(*User).ID)
+	}
+
+	client.Close()
+	server.Close()
+
+	// Cold start
+	server = nano.New(config)
+	defer server.Close()
+	defer server.Clear()
+
+	users = server.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.False(t, users.Exists(keys[0]))
+
+	for i, key := range keys[1:] {
+		user, err := users.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(i+1), user.(*User).ID)
+	}
+}
+
+func TestCollectionForEach(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Clear()
+
+	for i := 0; i < 1000; i++ {
+		users.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	count := 0
+
+	users.ForEach(func(key string, value interface{}) bool {
+		assert.Equal(t, key, value.(*User).ID)
+		count++
+		return count < 10
+	})
+
+	assert.Equal(t, 10, count)
+}
+
+func TestCollectionAllContext(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Clear()
+
+	for i := 0; i < 1000; i++ {
+		users.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	records := users.AllContext(ctx)
+	record := <-records
+	assert.Equal(t, record.Key, record.Value.(*User).ID)
+
+	// Stop reading early, the channel must be closed eventually
+	cancel()
+	count := 0
+
+	for range records {
+		count++
+	}
+
+	assert.True(t, count < 1000)
+}
+
+func TestCollectionCount(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Clear()
+	assert.Equal(t, int64(0), users.Count())
+
+	users.Set("1", newUser(1))
+	users.Set("2", newUser(2))
+	assert.Equal(t, int64(2), users.Count())
+
+	// Overwriting doesn't change the count
+	users.Set("1", newUser(1))
+	assert.Equal(t, int64(2), users.Count())
+
+	// Deleting a missing key doesn't change the count
+	users.Delete("3")
+	assert.Equal(t, int64(2), users.Count())
+
+	users.Delete("1")
+	assert.Equal(t, int64(1), users.Count())
+
+	users.Clear()
+	assert.Equal(t, int64(0), users.Count())
+}
+
+func TestCollectionLoadError(t *testing.T) {
+	node, err := nano.Open(config)
+	assert.Nil(t, err)
+	defer node.Close()
+
+	db, err := node.NamespaceE("corrupt")
+	assert.Nil(t, err)
+	db.RegisterTypes(types...)
+
+	// Unregistered types
+	_, err = db.CollectionE("Unknown")
+	assert.NotNil(t, err)
+
+	// Corrupt files
+	filePath := path.Join(namespaceDirectory("corrupt"), "User.dat")
+	assert.Nil(t, ioutil.WriteFile(filePath, []byte("1\n{invalid\n"), 0644))
+	defer os.Remove(filePath)
+
+	_, err = db.CollectionE("User")
+	assert.NotNil(t, err)
+
+	// Values that can't be serialized
+	assert.Nil(t, ioutil.WriteFile(filePath, nil, 0644))
+	users, err := db.CollectionE("User")
+	assert.Nil(t, err)
+
+	for _, durability := range []nano.Durability{nano.Async(), nano.Sync()} {
+		users.SetDurability(durability)
+		assert.NotNil(t, users.SetE("1", func() {}))
+		assert.NotNil(t, users.Batch().Set("2", newUser(2)).Set("1", func() {}).Commit())
+		assert.False(t, users.Exists("1"))
+		assert.False(t, users.Exists("2"))
+	}
+
+	// Fields that can't be indexed
+	type Unindexable struct {
+		Tags map[string]string `nano:"index"`
+	}
+
+	db.RegisterTypeAs("Unindexable", (*Unindexable)(nil))
+	_, err = db.CollectionE("Unindexable")
+	assert.NotNil(t, err)
+
+	type Unexported struct {
+		email string `nano:"index"`
+	}
+
+	db.RegisterTypeAs("Unexported", (*Unexported)(nil))
+	_, err = db.CollectionE("Unexported")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not exported")
+}
@@ -1,5 +1,7 @@
 package nano
 
+import "time"
+
 // Configuration represents the nano configuration
 // which is only read once at node creation time.
 type Configuration struct {
@@ -11,4 +13,33 @@ type Configuration struct {
 
 	// Hosts represents a list of node addresses that this node should connect to.
 	Hosts []string
+
+	// Durability is the default durability of all collections.
+	// Individual collections can override it via SetDurability.
+	Durability Durability
+
+	// Forwarding decides how the server deals with clients that can't keep up with modifications.
+	Forwarding Forwarding
+
+	// Lazy clients don't download whole collections. Keys are fetched from the server
+	// when they are read for the first time and only fetched keys are kept up to date.
+	// Functions like Keys, Range, FindBy and All only see the keys that have been fetched or set.
+	Lazy bool
+
+	// TombstoneHorizon is the time deleted keys are remembered, so that older modifications
+	// arriving late can't restore them. It defaults to one week.
+	TombstoneHorizon time.Duration
+
+	// Recovery makes servers skip damaged records while loading collection files instead of
+	// failing to load the collection. The damaged records are moved to the .corrupt file.
+	Recovery bool
+
+	// NodeID is stored in the lowest bits of modification timestamps. If two nodes modify a key
+	// at the same time, the modification of the node with the higher ID wins. IDs need to be
+	// unique in the cluster, otherwise such conflicts can be resolved differently on each node.
+	// It defaults to a random ID between 1 and 65535.
+	NodeID uint16
+
+	// Progress is called on clients while they receive a collection from the server.
+	Progress func(progress TransferProgress)
 }
@@ -0,0 +1,42 @@
+package nano
+
+import "time"
+
+// DurabilityMode decides when modifications are written to disk.
+type DurabilityMode int
+
+const (
+	// DurabilityAsync writes modifications to disk shortly after they happened.
+	DurabilityAsync DurabilityMode = iota
+
+	// DurabilityInterval writes modifications to disk in a fixed interval.
+	DurabilityInterval
+
+	// DurabilitySync writes modifications to disk before Set and Delete return.
+	DurabilitySync
+)
+
+// Durability describes how modifications of a collection are persisted.
+// Only server nodes write to disk, client nodes ignore this setting.
+type Durability struct {
+	// Mode decides when modifications are written to disk.
+	Mode DurabilityMode
+
+	// Interval is the time between two disk writes in DurabilityInterval mode.
+	Interval time.Duration
+}
+
+// Async returns the default durability which writes modifications shortly after they happened.
+func Async() Durability {
+	return Durability{Mode: DurabilityAsync}
+}
+
+// Interval returns a durability that writes modifications to disk every time the interval has passed.
+func Interval(interval time.Duration) Durability {
+	return Durability{Mode: DurabilityInterval, Interval: interval}
+}
+
+// Sync returns a durability that writes modifications to disk before Set and Delete return.
+func Sync() Durability {
+	return Durability{Mode: DurabilitySync}
+}
@@ -0,0 +1,126 @@
+package nano
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// reapInterval is the time between two searches for expired keys.
+const reapInterval = 100 * time.Millisecond
+
+// SetWithTTL sets the value for the key and deletes the key after the given duration.
+// Expired keys are treated as missing by Get, even before they have been deleted.
+// A later Set removes the expiration time, Update keeps it.
+// It panics if the value can not be serialized and prints errors writing to disk,
+// use SetWithTTLE to handle the errors instead.
+func (collection *Collection) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	collection.reportSetError(collection.SetWithTTLE(key, value, ttl))
+}
+
+// SetWithTTLE sets the value for the key and deletes the key after the given duration.
+// It returns the same errors as SetE.
+func (collection *Collection) SetWithTTLE(key string, value interface{}, ttl time.Duration) error {
+	if value == nil {
+		return nil
+	}
+
+	lock := collection.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return collection.setAndBroadcast(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// TTL returns the remaining time until the key expires.
+// The second return value is false if the key doesn't have an expiration time.
+func (collection *Collection) TTL(key string) (time.Duration, bool) {
+	expiresAt := collection.expiresAt(key)
+
+	if expiresAt == 0 {
+		return 0, false
+	}
+
+	ttl := time.Duration(expiresAt - time.Now().UnixNano())
+
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return ttl, true
+}
+
+// expiresAt returns the expiration time of the key in nanoseconds or 0 if it doesn't expire.
+func (collection *Collection) expiresAt(key string) int64 {
+	if atomic.LoadInt64(&collection.expiring) == 0 {
+		return 0
+	}
+
+	expiresAt, exists := collection.expires.Load(key)
+
+	if !exists {
+		return 0
+	}
+
+	return expiresAt.(int64)
+}
+
+// isExpired reports whether the key has an expiration time in the past.
+func (collection *Collection) isExpired(key string) bool {
+	expiresAt := collection.expiresAt(key)
+	return expiresAt != 0 && expiresAt <= time.Now().UnixNano()
+}
+
+// storeExpiration sets the expiration time of the key, 0 removes it.
+// The caller must hold the key lock.
+func (collection *Collection) storeExpiration(key string, expiresAt int64) {
+	if expiresAt == 0 {
+		if atomic.LoadInt64(&collection.expiring) == 0 {
+			return
+		}
+
+		_, existed := collection.expires.LoadAndDelete(key)
+
+		if existed {
+			atomic.AddInt64(&collection.expiring, -1)
+		}
+
+		return
+	}
+
+	_, existed := collection.expires.Swap(key, expiresAt)
+
+	if !existed {
+		atomic.AddInt64(&collection.expiring, 1)
+	}
+}
+
+// reap deletes all expired keys and notifies the other nodes.
+func (collection *Collection) reap() {
+	if atomic.LoadInt64(&collection.expiring) == 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+
+	collection.expires.Range(func(key, expiresAt interface{}) bool {
+		if expiresAt.(int64) > now {
+			return true
+		}
+
+		lock := collection.keyLock(key.(string))
+		lock.Lock()
+
+		// The key might have been modified in the meantime
+		if collection.isExpired(key.(string)) {
+			err := collection.deleteAndBroadcast(key.(string))
+
+			if err != nil {
+				fmt.Println("Error writing collection", collection.name, "to disk", err)
+			}
+		}
+
+		lock.Unlock()
+		return true
+	})
+}
@@ -0,0 +1,114 @@
+package nano_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestCollectionTTL(t *testing.T) {
+	node := nano.New(config)
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Clear()
+
+	users.SetWithTTL("short", newUser(1), 50*time.Millisecond)
+	users.SetWithTTL("long", newUser(2), time.Hour)
+	users.SetWithTTL("reset", newUser(3), 50*time.Millisecond)
+	users.Set("reset", newUser(3))
+
+	accounts := node.Namespace("test").RegisterTypes((*Account)(nil)).Collection("Account")
+	accounts.Clear()
+	accounts.SetWithTTL("short", newAccount(1), 50*time.Millisecond)
+
+	ttl, expires := users.TTL("long")
+	assert.True(t, expires)
+	assert.True(t, ttl > 59*time.Minute)
+
+	_, expires = users.TTL("reset")
+	assert.False(t, expires)
+
+	_, err := users.Get("short")
+	assert.Nil(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Expired keys are missing before they are reaped
+	_, err = users.Get("short")
+	assert.NotNil(t, err)
+	assert.False(t, users.Exists("short"))
+	assert.True(t, users.Exists("reset"))
+	assert.DeepEqual(t, []string{"long", "reset"}, users.Keys())
+	assert.DeepEqual(t, []string{"reset"}, users.Range("r", "t", nano.ScanOptions{}))
+	assert.DeepEqual(t, []string{"long"}, users.Prefix("", nano.ScanOptions{Limit: 1}))
+
+	keys, err := accounts.FindKeysBy("Email", "user1@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+	accounts.Clear()
+
+	// The reaper deletes the expired key
+	deadline := time.Now().Add(2 * time.Second)
+
+	for users.Count() > 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, int64(2), users.Count())
+
+	node.Close()
+
+	// Expiration times are persisted
+	node = nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(2), users.Count())
+
+	ttl, expires = users.TTL("long")
+	assert.True(t, expires)
+	assert.True(t, ttl > 59*time.Minute)
+
+	_, expires = users.TTL("reset")
+	assert.False(t, expires)
+}
+
+func TestClusterTTL(t *testing.T) {
+	server := nano.New(config)
+	client := nano.New(config)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	clientUsers.SetWithTTL("session", newUser(1), 200*time.Millisecond)
+
+	// The expiration time is replicated with the value
+	for !serverUsers.Exists("session") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, expires := serverUsers.TTL("session")
+	assert.True(t, expires)
+
+	// The expiration is replicated to the client as a delete
+	deadline := time.Now().Add(2 * time.Second)
+
+	for clientUsers.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, int64(0), clientUsers.Count())
+	assert.Equal(t, int64(0), serverUsers.Count())
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
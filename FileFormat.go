@@ -0,0 +1,467 @@
+package nano
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+)
+
+// fileMagic identifies snapshots and logs in the binary format.
+// Files without it are read in the legacy line format.
+const fileMagic = "\x89NANO"
+
+// fileFormatVersion is the version of the binary file format.
+const fileFormatVersion = 1
+
+// recordFieldCount is the number of length-prefixed fields in a record.
+const recordFieldCount = 3
+
+// maxRecordFieldSize limits the size of a record field,
+// so that a corrupted length can't allocate huge amounts of memory.
+const maxRecordFieldSize = 1 << 30
+
+// errChecksumMismatch is returned when a record has been damaged.
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+// Snapshots and write-ahead logs start with a header that is followed by the records:
+//
+//	header: magic | version (1 byte) | codec name length (1 byte) | codec name
+//	record: key length (uint32) | key | metadata length (uint32) | metadata | value length (uint32) | value | CRC-32 (uint32)
+//
+// In logs, the key is prefixed with the operation of the record.
+// The metadata consists of the space-separated fields written by formatMetadata.
+// Tombstones and deletions have an empty value. All integers are stored
+// in big endian byte order and the checksum covers all previous fields of the record.
+
+// writeFileHeader writes the header of a snapshot or log.
+func writeFileHeader(writer *bufio.Writer, codec Codec) error {
+	name := codec.Name()
+
+	if len(name) > 255 {
+		return errors.New("Codec name is too long: " + name)
+	}
+
+	_, err := writer.WriteString(fileMagic)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write([]byte{fileFormatVersion, byte(len(name))})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.WriteString(name)
+	return err
+}
+
+// writeSnapshotRecords writes the records of the collection in the binary format.
+func (collection *Collection) writeSnapshotRecords(writer *bufio.Writer, codec Codec, records []keyRecord) error {
+	cleared := atomic.LoadInt64(&collection.cleared)
+
+	if cleared != 0 {
+		err := writeRecord(writer, nil, []byte(formatMetadata(keyMetadata{cleared: cleared})), nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, record := range records {
+		var value []byte
+
+		if record.metadata.deleted == 0 {
+			var err error
+			value, err = codec.Marshal(record.Value)
+
+			if err != nil {
+				// Skip the record instead of losing the whole file
+				fmt.Println("Error encoding key", record.Key, "of collection", collection.name, err)
+				continue
+			}
+		}
+
+		err := writeRecord(writer, []byte(record.Key), []byte(formatMetadata(record.metadata)), value)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRecord writes a single length-prefixed record followed by its checksum.
+func writeRecord(writer *bufio.Writer, key []byte, metadata []byte, value []byte) error {
+	checksum := crc32.NewIEEE()
+	output := io.MultiWriter(writer, checksum)
+	length := make([]byte, 4)
+
+	for _, field := range [][]byte{key, metadata, value} {
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		_, err := output.Write(length)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = output.Write(field)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	binary.BigEndian.PutUint32(length, checksum.Sum32())
+	_, err := writer.Write(length)
+	return err
+}
+
+// hasFileHeader reports whether the reader starts with the header of the binary format.
+func hasFileHeader(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(fileMagic))
+	return err == nil && string(magic) == fileMagic
+}
+
+// readFileHeader reads the header of a snapshot or log
+// and returns its codec together with the size of the header.
+func readFileHeader(reader *bufio.Reader) (Codec, int, error) {
+	name, headerSize, err := readFileHeaderCodecName(reader)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	codec, err := codecByName(name)
+	return codec, headerSize, err
+}
+
+// readFileHeaderCodecName reads the header of a snapshot or log
+// and returns the name of its codec together with the size of the header.
+func readFileHeaderCodecName(reader *bufio.Reader) (string, int, error) {
+	header := make([]byte, len(fileMagic)+2)
+	_, err := io.ReadFull(reader, header)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	version := header[len(fileMagic)]
+
+	if version != fileFormatVersion {
+		return "", 0, errors.New("Unsupported file format version: " + strconv.Itoa(int(version)))
+	}
+
+	name := make([]byte, header[len(fileMagic)+1])
+	_, err = io.ReadFull(reader, name)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	return string(name), len(header) + len(name), nil
+}
+
+// fileCodecName returns the name of the codec that a snapshot or log
+// in the binary or the legacy line format has been written with.
+func fileCodecName(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	if hasFileHeader(reader) {
+		name, _, err := readFileHeaderCodecName(reader)
+		return name, err
+	}
+
+	name, _, err := readLegacyHeaderCodecName(reader)
+	return name, err
+}
+
+// readSnapshotRecords decodes all records of a binary snapshot
+// and calls the function for each one of them.
+func (collection *Collection) readSnapshotRecords(file *os.File, reader *bufio.Reader, callback func(key string, value interface{}, metadata keyMetadata)) error {
+	codec, headerSize, err := readFileHeader(reader)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.readFileRecords(file, int64(headerSize), false, func(keyField []byte, metadataField []byte, data []byte) error {
+		key := string(keyField)
+		metadata, err := parseMetadata(string(metadataField))
+
+		if err != nil {
+			return collection.skipDamaged(keyField, metadataField, data, err)
+		}
+
+		if metadata.deleted != 0 || metadata.cleared != 0 {
+			callback(key, nil, metadata)
+			return nil
+		}
+
+		obj, err := collection.decode(codec, data)
+
+		if err != nil {
+			return collection.skipDamaged(keyField, metadataField, data, err)
+		}
+
+		callback(key, obj, metadata)
+		return nil
+	})
+
+	return err
+}
+
+// readRecord reads a single record, verifies its checksum and returns the size of the record.
+// It returns io.EOF at the end of the file and io.ErrUnexpectedEOF if the record is incomplete.
+// Records with a wrong checksum are returned together with errChecksumMismatch.
+func readRecord(reader *bufio.Reader) (key []byte, metadata []byte, value []byte, size int, err error) {
+	checksum := crc32.NewIEEE()
+	input := io.TeeReader(reader, checksum)
+	fields := make([][]byte, recordFieldCount)
+	length := make([]byte, 4)
+
+	for i := range fields {
+		_, err = io.ReadFull(input, length)
+
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+
+		size := binary.BigEndian.Uint32(length)
+
+		if size > maxRecordFieldSize {
+			return nil, nil, nil, 0, errChecksumMismatch
+		}
+
+		fields[i] = make([]byte, size)
+		_, err = io.ReadFull(input, fields[i])
+
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+	}
+
+	_, err = io.ReadFull(reader, length)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	size = 4 + len(fields[0]) + 4 + len(fields[1]) + 4 + len(fields[2]) + 4
+
+	if binary.BigEndian.Uint32(length) != checksum.Sum32() {
+		return fields[0], fields[1], fields[2], size, errChecksumMismatch
+	}
+
+	return fields[0], fields[1], fields[2], size, nil
+}
+
+// writeLogFileRecord writes a single record to a log in the binary format.
+// The operation is the first byte of the key field.
+func writeLogFileRecord(writer *bufio.Writer, operation byte, key string, metadata keyMetadata, value []byte) error {
+	return writeRecord(writer, append([]byte{operation}, key...), []byte(formatMetadata(metadata)), value)
+}
+
+// parseLogFileRecord splits the key field of a log record in the binary format
+// into the operation and the key and parses the metadata field.
+func parseLogFileRecord(keyField []byte, metadataField []byte) (operation byte, key string, metadata keyMetadata, err error) {
+	if len(keyField) == 0 {
+		return 0, "", keyMetadata{}, errors.New("Invalid log record")
+	}
+
+	operation = keyField[0]
+
+	switch operation {
+	case logSet, logDelete, logHistory:
+	default:
+		return 0, "", keyMetadata{}, errors.New("Invalid log operation")
+	}
+
+	metadata, err = parseMetadata(string(metadataField))
+
+	if err != nil {
+		return 0, "", keyMetadata{}, err
+	}
+
+	return operation, string(keyField[1:]), metadata, nil
+}
+
+// readFileRecords reads the records of a snapshot or log in the binary format,
+// starting at the offset after the header, and calls the function for each one of them.
+// It returns the offset after the last record that has been read.
+//
+// A damaged record is only treated as the end of a log if no undamaged record follows it,
+// because that is the result of an interrupted write. Any other damage is an error.
+// In recovery mode, the damaged bytes are moved to the .corrupt file instead
+// and reading continues with the next undamaged record.
+func (collection *Collection) readFileRecords(file *os.File, offset int64, log bool, callback func(key []byte, metadata []byte, value []byte) error) (int64, error) {
+	_, err := file.Seek(offset, io.SeekStart)
+
+	if err != nil {
+		return offset, err
+	}
+
+	reader := bufio.NewReader(file)
+
+	for {
+		key, metadata, value, size, err := readRecord(reader)
+
+		if err == io.EOF {
+			return offset, nil
+		}
+
+		if err == nil {
+			err = callback(key, metadata, value)
+
+			if err != nil {
+				return offset, err
+			}
+
+			offset += int64(size)
+			continue
+		}
+
+		if err != io.ErrUnexpectedEOF && err != errChecksumMismatch {
+			return offset, err
+		}
+
+		damaged, followed, err := damagedBytes(file, offset)
+
+		if err != nil {
+			return offset, err
+		}
+
+		if log && !followed {
+			return offset, nil
+		}
+
+		if !collection.recovery {
+			return offset, errors.New("Damaged record at offset " + strconv.FormatInt(offset, 10) + " of " + path.Base(file.Name()) + ", use Repair to move it to " + collection.name + ".corrupt")
+		}
+
+		err = collection.skipDamaged(nil, nil, damaged, errChecksumMismatch)
+
+		if err != nil {
+			return offset, err
+		}
+
+		offset += int64(len(damaged))
+		_, err = file.Seek(offset, io.SeekStart)
+
+		if err != nil {
+			return offset, err
+		}
+
+		reader.Reset(file)
+	}
+}
+
+// damagedBytes returns the bytes of the file from the damaged record at the offset
+// up to the next undamaged record and reports whether such a record follows.
+// A damaged length can't be trusted, so the next record is searched byte by byte.
+func damagedBytes(file *os.File, offset int64) ([]byte, bool, error) {
+	stat, err := file.Stat()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	data := make([]byte, stat.Size()-offset)
+	_, err = file.ReadAt(data, offset)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i := 1; i < len(data); i++ {
+		if validRecord(data[i:]) {
+			return data[:i], true, nil
+		}
+	}
+
+	return data, false, nil
+}
+
+// validRecord reports whether the data starts with a complete record that has a valid checksum.
+func validRecord(data []byte) bool {
+	end := 0
+
+	for field := 0; field < recordFieldCount; field++ {
+		if len(data)-end < 4 {
+			return false
+		}
+
+		size := binary.BigEndian.Uint32(data[end:])
+		end += 4
+
+		if uint64(size) > uint64(len(data)-end) {
+			return false
+		}
+
+		end += int(size)
+	}
+
+	if len(data)-end < 4 {
+		return false
+	}
+
+	return binary.BigEndian.Uint32(data[end:]) == crc32.ChecksumIEEE(data[:end])
+}
+
+// decode decodes the value of a record in the binary format into a new object of the collection type.
+func (collection *Collection) decode(codec Codec, data []byte) (interface{}, error) {
+	obj := reflect.New(collection.typ).Interface()
+	err := codec.Unmarshal(data, obj)
+	return obj, err
+}
+
+// replaceLegacyFiles writes the loaded data to a snapshot in the binary format
+// and removes the logs in the legacy line format, so that new records
+// are never appended to them.
+func (collection *Collection) replaceLegacyFiles() error {
+	err := collection.writeSnapshot()
+
+	if err != nil {
+		return err
+	}
+
+	for _, extension := range []string{".wal.old", ".wal"} {
+		err = os.Remove(collection.filePath(extension))
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	collection.legacyFiles = false
+	return nil
+}
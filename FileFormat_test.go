@@ -0,0 +1,159 @@
+package nano_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestFileFormat(t *testing.T) {
+	const key = "special \r\t\"key\""
+
+	node := nano.New(config)
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Set(key, newUser(1))
+	node.Close()
+
+	// Keys with special characters survive the write-ahead log
+	node = nano.New(config)
+	users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.True(t, users.Exists(key))
+
+	// Changing the codec triggers a compaction
+	users.SetCodec(nano.MessagePack())
+	node.Close()
+
+	snapshot, err := ioutil.ReadFile(path.Join(namespaceDirectory("test"), "User.dat"))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(snapshot), "\x89NANO\x01\x07msgpack"))
+
+	// Keys with special characters survive the snapshot
+	node = nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+	user, err := users.Get(key)
+	assert.Nil(t, err)
+	assert.DeepEqual(t, newUser(1), user)
+}
+
+func TestFileFormatChecksum(t *testing.T) {
+	node := nano.New(config)
+	users := node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	users.Set("1", newUser(1))
+	users.SetCodec(nano.JSON())
+	node.Close()
+
+	// Damage a single byte of the value
+	filePath := path.Join(namespaceDirectory("corrupt"), "User.dat")
+	defer os.Remove(filePath)
+	defer os.Remove(path.Join(namespaceDirectory("corrupt"), "User.wal"))
+
+	snapshot, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+
+	index := strings.Index(string(snapshot), "Test User")
+	assert.True(t, index > 0)
+	snapshot[index] = 'B'
+	assert.Nil(t, ioutil.WriteFile(filePath, snapshot, 0644))
+
+	node = nano.New(config)
+	defer node.Close()
+
+	_, err = node.Namespace("corrupt").RegisterTypes(types...).CollectionE("User")
+	assert.NotNil(t, err)
+}
+
+// writeLegacySnapshot writes a User snapshot with the key "legacy" in the legacy line format
+// to the test namespace and returns the namespace directory.
+func writeLegacySnapshot(t *testing.T) string {
+	directory := namespaceDirectory("test")
+	assert.Nil(t, os.MkdirAll(directory, 0777))
+	assert.Nil(t, ioutil.WriteFile(path.Join(directory, "User.dat"), []byte("legacy\n{\"ID\":\"1\",\"Name\":\"Legacy\"}\n"), 0644))
+	return directory
+}
+
+func TestFileFormatLegacyLog(t *testing.T) {
+	directory := writeLegacySnapshot(t)
+	assert.Nil(t, ioutil.WriteFile(path.Join(directory, "User.wal"), []byte("=1\n+log\n{\"ID\":\"2\",\"Name\":\"Log\"}\n-legacy\n"), 0644))
+
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.False(t, users.Exists("legacy"))
+	user, err := users.Get("log")
+	assert.Nil(t, err)
+	assert.Equal(t, "Log", user.(*User).Name)
+
+	// Legacy files are replaced by the binary format while loading
+	for _, extension := range []string{".dat", ".wal"} {
+		data, err := ioutil.ReadFile(path.Join(directory, "User"+extension))
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(data), "\x89NANO"))
+	}
+}
+
+func TestFileFormatDamagedLog(t *testing.T) {
+	defer removeCollectionFiles("corrupt")
+	filePath := path.Join(namespaceDirectory("corrupt"), "User.wal")
+
+	node := nano.New(config)
+	users := node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+
+	for i := 0; i < 22; i++ {
+		users.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	node.Close()
+
+	// An incomplete record at the end of the log is the result of an interrupted write
+	log, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filePath, log[:len(log)-1], 0644))
+
+	node = nano.New(config)
+	users = node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(21), users.Count())
+	node.Close()
+
+	// A damaged record in the middle of the log is an error
+	log, err = ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+	index := strings.Index(string(log), "Test User")
+	assert.True(t, index > 0)
+	log[index] = 'B'
+	assert.Nil(t, ioutil.WriteFile(filePath, log, 0644))
+
+	node = nano.New(config)
+	_, err = node.Namespace("corrupt").RegisterTypes(types...).CollectionE("User")
+	assert.NotNil(t, err)
+	node.Close()
+
+	stat, err := os.Stat(filePath)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(log)), stat.Size())
+
+	// Recovery mode only skips the damaged record
+	recoveryConfig := config
+	recoveryConfig.Recovery = true
+
+	node = nano.New(recoveryConfig)
+	defer node.Close()
+
+	users = node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(1), users.CorruptRecords())
+	assert.Equal(t, int64(20), users.Count())
+
+	corrupt, err := ioutil.ReadFile(path.Join(namespaceDirectory("corrupt"), "User.corrupt"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(corrupt), "Best User"))
+}
@@ -0,0 +1,85 @@
+package nano
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ForwardingMode decides what the server does when a client can't keep up with its packets.
+type ForwardingMode int
+
+const (
+	// ForwardingDrop discards packets for clients whose send buffer is full.
+	ForwardingDrop ForwardingMode = iota
+
+	// ForwardingBlock waits for free space in the send buffer until the timeout has passed.
+	ForwardingBlock
+
+	// ForwardingQueue moves packets that don't fit into the send buffer to a replay queue.
+	ForwardingQueue
+
+	// ForwardingResync discards packets and lets the client resynchronize its collections.
+	ForwardingResync
+)
+
+// Forwarding describes how the server sends modifications to clients that can't keep up.
+// Packets that couldn't be sent are counted in Node.DroppedPackets.
+type Forwarding struct {
+	// Mode decides what happens when the send buffer of a client is full.
+	Mode ForwardingMode
+
+	// Timeout is the maximum time to wait for a client in ForwardingBlock mode.
+	Timeout time.Duration
+
+	// QueueSize is the maximum number of queued packets per client in ForwardingQueue mode.
+	QueueSize int
+}
+
+// validate rejects forwardings that would lose every packet or can't be created.
+func (forwarding Forwarding) validate() error {
+	switch forwarding.Mode {
+	case ForwardingDrop, ForwardingResync:
+		return nil
+
+	case ForwardingBlock:
+		if forwarding.Timeout <= 0 {
+			return errors.New("Forwarding timeout must be positive: " + forwarding.Timeout.String())
+		}
+
+		return nil
+
+	case ForwardingQueue:
+		if forwarding.QueueSize <= 0 {
+			return errors.New("Forwarding queue size must be positive: " + strconv.Itoa(forwarding.QueueSize))
+		}
+
+		return nil
+
+	default:
+		return errors.New("Unknown forwarding mode: " + strconv.Itoa(int(forwarding.Mode)))
+	}
+}
+
+// DropPackets returns the default forwarding which discards packets for slow clients.
+func DropPackets() Forwarding {
+	return Forwarding{Mode: ForwardingDrop}
+}
+
+// BlockPackets returns a forwarding that waits up to the given timeout for slow clients.
+// The timeout must be positive.
+func BlockPackets(timeout time.Duration) Forwarding {
+	return Forwarding{Mode: ForwardingBlock, Timeout: timeout}
+}
+
+// QueuePackets returns a forwarding that queues up to the given number of packets per slow client.
+// The size must be positive.
+func QueuePackets(size int) Forwarding {
+	return Forwarding{Mode: ForwardingQueue, QueueSize: size}
+}
+
+// ResyncClients returns a forwarding that lets slow clients resynchronize
+// instead of receiving the packets they missed.
+func ResyncClients() Forwarding {
+	return Forwarding{Mode: ForwardingResync}
+}
@@ -0,0 +1,153 @@
+package nano_test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/aerogo/packet"
+	"github.com/akyoto/assert"
+)
+
+func TestClusterForwarding(t *testing.T) {
+	policies := []nano.Forwarding{
+		nano.BlockPackets(time.Second),
+		nano.QueuePackets(1000),
+		nano.ResyncClients(),
+	}
+
+	for _, forwarding := range policies {
+		serverConfig := config
+		serverConfig.Forwarding = forwarding
+		server := nano.New(serverConfig)
+		client := nano.New(config)
+
+		// Wait for the client to connect
+		for server.Server().ClientCount() < 1 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+		clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+		recordCount := 1000
+
+		for i := 0; i < recordCount; i++ {
+			serverUsers.Set(strconv.Itoa(i), newUser(i))
+		}
+
+		start := time.Now()
+
+		for clientUsers.Count() < int64(recordCount) && time.Since(start) < 5*time.Second {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		assert.Equal(t, int64(recordCount), clientUsers.Count())
+		assert.Equal(t, uint64(0), server.DroppedPackets())
+
+		client.Clear()
+		client.Close()
+		server.Clear()
+		server.Close()
+	}
+}
+
+func TestForwardingSlowClient(t *testing.T) {
+	// Enough packets to fill the send buffer and the socket buffers of a client that doesn't read
+	const packetCount = 30000
+
+	// Packet types of the resynchronization request and of the test packets
+	const packetResync = 6
+	const packetTest = 200
+	payload := make([]byte, 1024)
+
+	tests := []struct {
+		forwarding nano.Forwarding
+		readDelay  time.Duration
+		dropped    bool
+	}{
+		{nano.DropPackets(), 0, true},
+		{nano.BlockPackets(5 * time.Second), 500 * time.Millisecond, false},
+		{nano.QueuePackets(packetCount), 0, false},
+		{nano.QueuePackets(10), 0, true},
+		{nano.ResyncClients(), 0, true},
+	}
+
+	for _, test := range tests {
+		serverConfig := config
+		serverConfig.Forwarding = test.forwarding
+		server := nano.New(serverConfig)
+
+		connection, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+		assert.Nil(t, err)
+
+		// A small socket buffer makes the send buffer of the server fill up quickly
+		assert.Nil(t, connection.(*net.TCPConn).SetReadBuffer(4096))
+
+		for server.Server().ClientCount() < 1 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// The client starts reading after the delay or after all packets have been sent
+		stream := packet.NewStream(packetCount)
+
+		startReading := func() {
+			_ = connection.(*net.TCPConn).SetReadBuffer(4 * 1024 * 1024)
+			stream.SetConnection(connection)
+		}
+
+		if test.readDelay > 0 {
+			time.AfterFunc(test.readDelay, startReading)
+		}
+
+		for i := 0; i < packetCount; i++ {
+			server.Broadcast(packet.New(packetTest, payload))
+		}
+
+		if test.readDelay == 0 {
+			startReading()
+		}
+
+		assert.Equal(t, test.dropped, server.DroppedPackets() > 0)
+		received := 0
+		resync := false
+		timeout := time.After(5 * time.Second)
+
+	read:
+		for received+int(server.DroppedPackets()) < packetCount || (test.forwarding.Mode == nano.ForwardingResync && !resync) {
+			select {
+			case msg := <-stream.Incoming:
+				if msg.Type == packetResync {
+					resync = true
+				} else {
+					received++
+				}
+
+			case <-timeout:
+				break read
+			}
+		}
+
+		assert.Equal(t, packetCount, received+int(server.DroppedPackets()))
+		assert.Equal(t, test.forwarding.Mode == nano.ForwardingResync, resync)
+
+		// Keep reading until the server has sent its close packet
+		go func() {
+			for range stream.Incoming {
+			}
+		}()
+
+		server.Close()
+		stream.Close()
+	}
+}
+
+func TestForwardingInvalid(t *testing.T) {
+	for _, forwarding := range []nano.Forwarding{nano.QueuePackets(0), nano.QueuePackets(-1), nano.BlockPackets(0), {Mode: 42}} {
+		invalidConfig := config
+		invalidConfig.Forwarding = forwarding
+		_, err := nano.Open(invalidConfig)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,226 @@
+package nano
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IndexTag is the struct tag value that marks a field as indexed,
+// e.g. `nano:"index"`.
+const IndexTag = "index"
+
+// index maps the values of a struct field to the keys of the objects having that value.
+// Slice and array fields are indexed by each of their elements.
+type index struct {
+	field  int
+	multi  bool
+	typ    reflect.Type
+	values map[interface{}]map[string]struct{}
+	keys   map[string][]interface{}
+	mutex  sync.RWMutex
+}
+
+// newIndexes creates an index for every field of the type that has the index tag.
+// It returns an error if a tagged field can not be indexed.
+func newIndexes(typ reflect.Type) (map[string]*index, error) {
+	indexes := map[string]*index{}
+
+	if typ.Kind() != reflect.Struct {
+		return indexes, nil
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+
+		if !hasTagOption(field.Tag.Get("nano"), IndexTag) {
+			continue
+		}
+
+		// Values of unexported fields can't be read through reflection
+		if !field.IsExported() {
+			return nil, errors.New("Field " + typ.Name() + "." + field.Name + " is not exported and can not be indexed")
+		}
+
+		idx := &index{
+			field:  i,
+			typ:    field.Type,
+			values: map[interface{}]map[string]struct{}{},
+			keys:   map[string][]interface{}{},
+		}
+
+		if field.Type.Kind() == reflect.Slice || field.Type.Kind() == reflect.Array {
+			idx.multi = true
+			idx.typ = field.Type.Elem()
+		}
+
+		if !idx.typ.Comparable() {
+			return nil, errors.New("Field " + typ.Name() + "." + field.Name + " of type " + field.Type.String() + " can not be indexed")
+		}
+
+		indexes[field.Name] = idx
+	}
+
+	return indexes, nil
+}
+
+// update replaces the indexed values of the key with the ones from the new value.
+// A nil value removes the key from the index.
+func (idx *index) update(key string, value interface{}) {
+	newValues := idx.extract(value)
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	for _, old := range idx.keys[key] {
+		keys := idx.values[old]
+		delete(keys, key)
+
+		if len(keys) == 0 {
+			delete(idx.values, old)
+		}
+	}
+
+	if len(newValues) == 0 {
+		delete(idx.keys, key)
+		return
+	}
+
+	for _, fieldValue := range newValues {
+		keys, exists := idx.values[fieldValue]
+
+		if !exists {
+			keys = map[string]struct{}{}
+			idx.values[fieldValue] = keys
+		}
+
+		keys[key] = struct{}{}
+	}
+
+	idx.keys[key] = newValues
+}
+
+// find returns the sorted keys of all objects whose field has the given value.
+func (idx *index) find(value interface{}) []string {
+	fieldValue := reflect.ValueOf(value)
+
+	if !fieldValue.IsValid() {
+		return nil
+	}
+
+	if fieldValue.Type() != idx.typ {
+		if !fieldValue.Type().ConvertibleTo(idx.typ) {
+			return nil
+		}
+
+		value = fieldValue.Convert(idx.typ).Interface()
+	}
+
+	idx.mutex.RLock()
+	keys := make([]string, 0, len(idx.values[value]))
+
+	for key := range idx.values[value] {
+		keys = append(keys, key)
+	}
+
+	idx.mutex.RUnlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+// extract returns the indexed field values of the object.
+func (idx *index) extract(value interface{}) []interface{} {
+	if value == nil {
+		return nil
+	}
+
+	obj := reflect.ValueOf(value)
+
+	for obj.Kind() == reflect.Ptr || obj.Kind() == reflect.Interface {
+		if obj.IsNil() {
+			return nil
+		}
+
+		obj = obj.Elem()
+	}
+
+	if obj.Kind() != reflect.Struct || idx.field >= obj.NumField() {
+		return nil
+	}
+
+	field := obj.Field(idx.field)
+
+	if !idx.multi {
+		return []interface{}{field.Interface()}
+	}
+
+	values := make([]interface{}, 0, field.Len())
+
+	for i := 0; i < field.Len(); i++ {
+		values = append(values, field.Index(i).Interface())
+	}
+
+	return values
+}
+
+// FindKeysBy returns the sorted keys of all objects whose indexed field has the given value.
+func (collection *Collection) FindKeysBy(field string, value interface{}) ([]string, error) {
+	idx, exists := collection.indexes[field]
+
+	if !exists {
+		return nil, errors.New("Field " + field + " of " + collection.name + " is not indexed")
+	}
+
+	keys := idx.find(value)
+	valid := keys[:0]
+
+	for _, key := range keys {
+		if !collection.isExpired(key) {
+			valid = append(valid, key)
+		}
+	}
+
+	return valid, nil
+}
+
+// FindBy returns all objects whose indexed field has the given value.
+func (collection *Collection) FindBy(field string, value interface{}) ([]interface{}, error) {
+	keys, err := collection.FindKeysBy(field, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]interface{}, 0, len(keys))
+
+	for _, key := range keys {
+		obj, err := collection.Get(key)
+
+		if err == nil {
+			objects = append(objects, obj)
+		}
+	}
+
+	return objects, nil
+}
+
+// updateIndexes keeps all indexes up to date with the new value of the key.
+func (collection *Collection) updateIndexes(key string, value interface{}) {
+	for _, idx := range collection.indexes {
+		idx.update(key, value)
+	}
+}
+
+// hasTagOption reports whether the comma separated tag contains the option.
+func hasTagOption(tag string, option string) bool {
+	for _, part := range strings.Split(tag, ",") {
+		if strings.TrimSpace(part) == option {
+			return true
+		}
+	}
+
+	return false
+}
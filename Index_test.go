@@ -0,0 +1,86 @@
+package nano_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+type Account struct {
+	Name  string
+	Email string `nano:"index"`
+}
+
+func newAccount(id int) *Account {
+	return &Account{
+		Name:  "Test Account",
+		Email: "user" + strconv.Itoa(id) + "@example.com",
+	}
+}
+
+func TestCollectionFindBy(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	accounts := node.Namespace("test").RegisterTypes((*Account)(nil)).Collection("Account")
+	accounts.Clear()
+	accounts.Set("1", newAccount(1))
+	accounts.Set("2", newAccount(2))
+
+	objects, err := accounts.FindBy("Email", "user1@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+	assert.DeepEqual(t, newAccount(1), objects[0])
+
+	// Changing the field updates the index
+	accounts.Set("2", newAccount(1))
+
+	keys, err := accounts.FindKeysBy("Email", "user1@example.com")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, []string{"1", "2"}, keys)
+
+	keys, err = accounts.FindKeysBy("Email", "user2@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+
+	// Deleting removes the key from the index
+	accounts.Delete("1")
+
+	keys, err = accounts.FindKeysBy("Email", "user1@example.com")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, []string{"2"}, keys)
+
+	// Fields without an index tag can't be queried
+	_, err = accounts.FindBy("Name", "Test Account")
+	assert.NotNil(t, err)
+}
+
+func TestClusterFindBy(t *testing.T) {
+	server := nano.New(config)
+	client := nano.New(config)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverAccounts := server.Namespace("test").RegisterTypes((*Account)(nil)).Collection("Account")
+	clientAccounts := client.Namespace("test").RegisterTypes((*Account)(nil)).Collection("Account")
+	clientAccounts.Set("remote", newAccount(7))
+
+	// Wait until it propagates to the server
+	time.Sleep(150 * time.Millisecond)
+
+	keys, err := serverAccounts.FindKeysBy("Email", "user7@example.com")
+	assert.Nil(t, err)
+	assert.DeepEqual(t, []string{"remote"}, keys)
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
@@ -0,0 +1,144 @@
+package nano
+
+import (
+	"strconv"
+	"strings"
+)
+
+// keyMetadataSeparator separates the key from its metadata in the key line
+// of network packets and collection transfers.
+const keyMetadataSeparator = "\x00"
+
+// keyEscaper escapes the characters that would end the key in a key line.
+var keyEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", keyMetadataSeparator, "\\0")
+
+// keyUnescaper reverts the escaping of keyEscaper.
+var keyUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\0", keyMetadataSeparator)
+
+// keyMetadata is the additional information stored in a key line.
+// Fields with a zero value are omitted.
+type keyMetadata struct {
+	// expiresAt is the expiration time in nanoseconds.
+	expiresAt int64
+
+	// modified is the timestamp of the last modification used to resolve conflicts.
+	// It is only sent in collection transfers.
+	modified int64
+
+	// changed is the time the server applied the last modification.
+	// It is only stored in the write-ahead log.
+	changed int64
+
+	// deleted is the timestamp of the deletion of the key.
+	// Records with a deletion time are tombstones.
+	deleted int64
+
+	// cleared is the time of the last Clear of the collection.
+	// It is only stored in a snapshot record without a key.
+	cleared int64
+}
+
+// keyRecord is a key/value pair together with the metadata of the key.
+type keyRecord struct {
+	KeyValue
+	metadata keyMetadata
+}
+
+// keyLine returns the escaped key together with its metadata.
+// Key lines are used in the line-based records of network packets and collection transfers,
+// the binary file format stores the key and the metadata in separate fields.
+func keyLine(key string, metadata keyMetadata) string {
+	if metadata == (keyMetadata{}) {
+		return keyEscaper.Replace(key)
+	}
+
+	return keyEscaper.Replace(key) + keyMetadataSeparator + formatMetadata(metadata)
+}
+
+// parseKeyLine splits a key line into the unescaped key and its metadata.
+func parseKeyLine(line string) (string, keyMetadata, error) {
+	key, metadata, err := parseLegacyKeyLine(line)
+	return keyUnescaper.Replace(key), metadata, err
+}
+
+// parseLegacyKeyLine splits a key line of the legacy line format into the key and its metadata.
+// Keys in legacy files are not escaped.
+func parseLegacyKeyLine(line string) (string, keyMetadata, error) {
+	key, fields, _ := strings.Cut(line, keyMetadataSeparator)
+	metadata, err := parseMetadata(fields)
+
+	if err != nil {
+		return "", metadata, err
+	}
+
+	return key, metadata, nil
+}
+
+// formatMetadata returns the metadata as space-separated fields.
+// Fields with a zero value are omitted.
+func formatMetadata(metadata keyMetadata) string {
+	fields := make([]string, 0, 5)
+
+	if metadata.expiresAt != 0 {
+		fields = append(fields, "expires="+strconv.FormatInt(metadata.expiresAt, 10))
+	}
+
+	if metadata.modified != 0 {
+		fields = append(fields, "modified="+strconv.FormatInt(metadata.modified, 10))
+	}
+
+	if metadata.changed != 0 {
+		fields = append(fields, "changed="+strconv.FormatInt(metadata.changed, 10))
+	}
+
+	if metadata.deleted != 0 {
+		fields = append(fields, "deleted="+strconv.FormatInt(metadata.deleted, 10))
+	}
+
+	if metadata.cleared != 0 {
+		fields = append(fields, "cleared="+strconv.FormatInt(metadata.cleared, 10))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// parseMetadata parses the space-separated metadata fields.
+// Unknown fields are ignored.
+func parseMetadata(fields string) (keyMetadata, error) {
+	metadata := keyMetadata{}
+
+	for _, field := range strings.Fields(fields) {
+		name, value, _ := strings.Cut(field, "=")
+		var target *int64
+
+		switch name {
+		case "expires":
+			target = &metadata.expiresAt
+
+		case "modified":
+			target = &metadata.modified
+
+		case "changed":
+			target = &metadata.changed
+
+		case "deleted":
+			target = &metadata.deleted
+
+		case "cleared":
+			target = &metadata.cleared
+
+		default:
+			continue
+		}
+
+		number, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil {
+			return metadata, err
+		}
+
+		*target = number
+	}
+
+	return metadata, nil
+}
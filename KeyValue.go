@@ -1,6 +1,7 @@
 package nano
 
-type keyValue struct {
-	key   string
-	value interface{}
+// KeyValue is a single key with the value stored for it.
+type KeyValue struct {
+	Key   string
+	Value interface{}
 }
@@ -0,0 +1,234 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aerogo/packet"
+)
+
+// fetchTimeout is the maximum time a lazy client waits for the server to send a key.
+const fetchTimeout = 5 * time.Second
+
+// fetchRequest is a pending request of a lazy client for a single key.
+type fetchRequest struct {
+	arrived chan struct{}
+	once    sync.Once
+}
+
+// done wakes up the goroutines waiting for the key.
+// Responses can arrive more than once, e.g. after a timed out request has been sent again.
+func (request *fetchRequest) done() {
+	request.once.Do(func() {
+		close(request.arrived)
+	})
+}
+
+// fetch requests a key that a lazy client doesn't know yet from the server
+// and waits until the response has been applied. Concurrent reads of the same key
+// share a single request and keys that have been fetched once are kept up to date
+// by the modifications the server forwards.
+func (collection *Collection) fetch(key string) error {
+	obj, requested := collection.fetched.LoadOrStore(key, &fetchRequest{arrived: make(chan struct{})})
+	request := obj.(*fetchRequest)
+
+	if !requested {
+		collection.requestKey(key)
+	}
+
+	timer := time.NewTimer(fetchTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-request.arrived:
+		return nil
+
+	case <-timer.C:
+		// The next read will request the key again
+		collection.fetched.CompareAndDelete(key, obj)
+		return errors.New("Fetching key " + key + " of collection " + collection.name + " timed out")
+	}
+}
+
+// requestKey asks the server to send the current state of the key.
+func (collection *Collection) requestKey(key string) {
+	packetData := bytes.Buffer{}
+	fmt.Fprintf(&packetData, "%s\n%s\n%s\n", collection.ns.name, collection.name, keyEscaper.Replace(key))
+	collection.node.Client().Stream.Outgoing <- packet.New(packetKeyRequest, packetData.Bytes())
+}
+
+// refetch requests all keys that a lazy client knows again,
+// because the server can't send the modifications it missed.
+func (collection *Collection) refetch() {
+	keys := map[string]struct{}{}
+
+	collection.fetched.Range(func(key, _ interface{}) bool {
+		keys[key.(string)] = struct{}{}
+		return true
+	})
+
+	collection.data.Range(func(key, _ interface{}) bool {
+		keys[key.(string)] = struct{}{}
+		return true
+	})
+
+	for key := range keys {
+		collection.requestKey(key)
+	}
+}
+
+// lookup returns the stored value of the key even if it has expired.
+// Lazy clients fetch unknown keys from the server.
+func (collection *Collection) lookup(key string) (interface{}, bool, error) {
+	value, exists := collection.data.Load(key)
+
+	if exists || !collection.lazy {
+		return value, exists, nil
+	}
+
+	err := collection.fetch(key)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, exists = collection.data.Load(key)
+	return value, exists, nil
+}
+
+// ignores reports whether a lazy client doesn't keep the key up to date,
+// because the key has neither been fetched nor written locally.
+func (collection *Collection) ignores(key string) bool {
+	if !collection.lazy {
+		return false
+	}
+
+	_, fetched := collection.fetched.Load(key)
+
+	if fetched {
+		return false
+	}
+
+	_, exists := collection.data.Load(key)
+	return !exists
+}
+
+// writeKey writes a single record with the current state of the key.
+// Keys that don't exist are sent as a delete record.
+func (collection *Collection) writeKey(writer *bufio.Writer, key string) error {
+	metadata := keyMetadata{
+		modified: collection.modificationTime(key),
+	}
+
+	value, exists := collection.data.Load(key)
+
+	if !exists || collection.isExpired(key) {
+		return writeLogRecord(writer, logDelete, key, metadata, nil)
+	}
+
+	encoded, err := collection.marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	metadata.expiresAt = collection.expiresAt(key)
+	return writeLogRecord(writer, logSet, key, metadata, encoded)
+}
+
+// serverAnswerKeyRequest sends the requested key to the client.
+func serverAnswerKeyRequest(client *packet.Stream, msg *packet.Packet, node *Node) error {
+	data := bytes.NewBuffer(msg.Data)
+	namespaceName := readLine(data)
+	collectionName := readLine(data)
+	key := keyUnescaper.Replace(readLine(data))
+
+	namespace, err := node.NamespaceE(namespaceName)
+
+	if err != nil {
+		return err
+	}
+
+	collection, err := namespace.CollectionE(collectionName)
+
+	if err != nil {
+		return err
+	}
+
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, "%s\n%s\n%d\n", namespaceName, collectionName, time.Now().UnixNano())
+	writer := bufio.NewWriter(&buffer)
+	err = collection.writeKey(writer, key)
+
+	if err != nil {
+		return err
+	}
+
+	err = writer.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	client.Outgoing <- packet.New(packetKeyResponse, buffer.Bytes())
+	return nil
+}
+
+// networkKeyResponse applies a key that a lazy client requested
+// and wakes up the goroutines waiting for it.
+func networkKeyResponse(msg *packet.Packet, db *Node) error {
+	data := bytes.NewBuffer(msg.Data)
+	namespace, err := db.NamespaceE(readLine(data))
+
+	if err != nil {
+		return err
+	}
+
+	collectionObj, exists := namespace.collections.Load(readLine(data))
+
+	if !exists || collectionObj == nil {
+		return nil
+	}
+
+	collection := collectionObj.(*Collection)
+	serverTime, err := strconv.ParseInt(readLine(data), 10, 64)
+
+	if err != nil {
+		return err
+	}
+
+	operation, key, metadata, encoded, _, err := readLogRecord(bufio.NewReader(data), parseKeyLine)
+
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+
+	if operation == logSet {
+		value, err = collection.unmarshal(encoded)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	collection.resyncKey(key, value, metadata)
+
+	// All fetched keys have been kept up to date since the first response
+	atomic.CompareAndSwapInt64(&collection.lastSeen, 0, serverTime)
+
+	obj, requested := collection.fetched.Load(key)
+
+	if requested {
+		obj.(*fetchRequest).done()
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aerogo/packet"
+	"github.com/akyoto/assert"
+)
+
+func TestLazyDuplicateKeyResponses(t *testing.T) {
+	server := New(Configuration{Port: 3000, Directory: t.TempDir()})
+	defer server.Close()
+
+	client := New(Configuration{Port: 3000, Directory: t.TempDir(), Lazy: true})
+	defer client.Close()
+
+	serverItems := server.Namespace("test").RegisterTypeAs("Item", &[]byte{}).Collection("Item")
+	serverItems.Set("1", []byte("1"))
+	clientItems := client.Namespace("test").RegisterTypeAs("Item", &[]byte{}).Collection("Item")
+
+	// The response to a retried request can arrive together with the late first one
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, "test\nItem\n%d\n", time.Now().UnixNano())
+	writer := bufio.NewWriter(&buffer)
+	assert.Nil(t, serverItems.writeKey(writer, "1"))
+	assert.Nil(t, writer.Flush())
+	msg := packet.New(packetKeyResponse, buffer.Bytes())
+
+	for i := 0; i < 1000; i++ {
+		request := &fetchRequest{arrived: make(chan struct{})}
+		clientItems.fetched.Store("1", request)
+		start := make(chan struct{})
+		wait := sync.WaitGroup{}
+
+		for j := 0; j < 8; j++ {
+			wait.Add(1)
+
+			go func() {
+				defer wait.Done()
+				<-start
+				assert.Nil(t, networkKeyResponse(msg, client))
+			}()
+		}
+
+		close(start)
+		wait.Wait()
+		<-request.arrived
+	}
+
+	assert.True(t, clientItems.Exists("1"))
+}
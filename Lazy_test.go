@@ -0,0 +1,117 @@
+package nano_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestClusterLazy(t *testing.T) {
+	lazyConfig := config
+	lazyConfig.Lazy = true
+
+	server := nano.New(config)
+	client := nano.New(lazyConfig)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+	serverUsers.Set("1", newUser(1))
+	serverUsers.Set("2", newUser(2))
+
+	// Nothing is downloaded when the collection is opened
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(0), clientUsers.Count())
+
+	user, err := clientUsers.Get("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", user.(*User).ID)
+	assert.Equal(t, int64(1), clientUsers.Count())
+
+	_, err = clientUsers.Get("missing")
+	assert.NotNil(t, err)
+	assert.False(t, clientUsers.Exists("missing"))
+
+	// Only fetched keys are kept up to date
+	serverUsers.Set("2", newUser(20))
+	serverUsers.Set("missing", newUser(3))
+
+	for !clientUsers.Exists("missing") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, int64(2), clientUsers.Count())
+
+	// Local writes are sent to the server
+	clientUsers.Set("4", newUser(4))
+
+	for !serverUsers.Exists("4") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
+
+func TestClusterLazyReconnect(t *testing.T) {
+	lazyConfig := config
+	lazyConfig.Lazy = true
+
+	server := nano.New(config)
+	client := nano.New(lazyConfig)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	for i := 1; i <= 3; i++ {
+		serverUsers.Set(strconv.Itoa(i), newUser(i))
+	}
+
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+	_, err := clientUsers.Get("1")
+	assert.Nil(t, err)
+
+	// The restarted server has no history of the modifications the client has seen
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+	server = nano.New(config)
+	serverUsers = server.Namespace("test").RegisterTypes(types...).Collection("User")
+	serverUsers.Set("1", newUser(10))
+
+	start := time.Now()
+
+	for {
+		user, err := clientUsers.Get("1")
+		assert.Nil(t, err)
+
+		if user.(*User).ID == "10" {
+			break
+		}
+
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("Client has not been resynchronized")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the known key has been fetched again
+	assert.Equal(t, int64(1), clientUsers.Count())
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
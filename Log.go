@@ -0,0 +1,506 @@
+package nano
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Operations recorded in the write-ahead log.
+const (
+	logSet    = '+'
+	logDelete = '-'
+
+	// logHistory is the first record of a new log. It contains the time
+	// since which the log knows every modification of the collection.
+	logHistory = '='
+)
+
+// logCompactionMinSize is the minimum size in bytes the write-ahead log
+// needs to reach before it is folded back into the snapshot.
+const logCompactionMinSize = 4 * 1024 * 1024
+
+// flush appends all pending modifications to the write-ahead log
+// and compacts the log once it has grown large enough.
+func (collection *Collection) flush() error {
+	if atomic.CompareAndSwapInt32(&collection.compactRequired, 1, 0) {
+		return collection.compact()
+	}
+
+	collection.fileMutex.Lock()
+	err := collection.appendLog()
+	logSize := collection.logSize
+	collection.fileMutex.Unlock()
+
+	if err != nil {
+		// The pending keys are lost, so the next flush needs to write a full snapshot.
+		atomic.StoreInt32(&collection.compactRequired, 1)
+		return err
+	}
+
+	if logSize >= logCompactionMinSize && logSize >= atomic.LoadInt64(&collection.snapshotSize) {
+		return collection.compact()
+	}
+
+	return nil
+}
+
+// appendLog writes a record for every pending key to the write-ahead log.
+// The caller must hold the file mutex.
+func (collection *Collection) appendLog() error {
+	if collection.log == nil {
+		return errors.New("Write-ahead log of " + collection.name + " is not open")
+	}
+
+	writer := bufio.NewWriter(collection.log)
+	recordCount := 0
+	var err error
+
+	collection.pending.Range(func(key, _ interface{}) bool {
+		// Delete the pending flag BEFORE reading the value,
+		// so that concurrent writes will mark the key again.
+		encoded, _ := collection.pending.LoadAndDelete(key)
+		value, exists := collection.data.Load(key)
+
+		if !exists {
+			err = writeLogFileRecord(writer, logDelete, key.(string), collection.logMetadata(key.(string)), nil)
+			recordCount++
+			return err == nil
+		}
+
+		data, encodeErr := collection.logValue(encoded, value)
+
+		if encodeErr != nil {
+			// Skip the record instead of blocking the whole log
+			fmt.Println("Error encoding key", key, "of collection", collection.name, encodeErr)
+			return true
+		}
+
+		err = writeLogFileRecord(writer, logSet, key.(string), collection.logMetadata(key.(string)), data)
+		recordCount++
+		return err == nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if recordCount == 0 {
+		return nil
+	}
+
+	err = writer.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	err = collection.log.Sync()
+
+	if err != nil {
+		return err
+	}
+
+	stat, err := collection.log.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	collection.logSize = stat.Size()
+	return nil
+}
+
+// logValue returns the value serialized with the codec of the log.
+// Values that have already been encoded with the same codec are not encoded again.
+// The encoded value can be older than the current value if the key has been
+// modified concurrently, but then the key is pending again and the next record
+// contains the current value.
+func (collection *Collection) logValue(encoded interface{}, value interface{}) ([]byte, error) {
+	pending, ok := encoded.(*encodedValue)
+
+	if ok && pending != nil && pending.codec.Name() == collection.logCodec.Name() {
+		return pending.data, nil
+	}
+
+	return collection.logCodec.Marshal(value)
+}
+
+// compact folds the write-ahead log back into the snapshot.
+func (collection *Collection) compact() error {
+	collection.compactMutex.Lock()
+	defer collection.compactMutex.Unlock()
+
+	// New modifications go to a fresh log while the snapshot is being written
+	collection.fileMutex.Lock()
+	err := collection.rotateLog()
+	collection.fileMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Old tombstones are not written to the new snapshot
+	collection.collectTombstones()
+	err = collection.writeSnapshot()
+
+	if err != nil {
+		return err
+	}
+
+	// The snapshot contains everything the rotated log had
+	err = os.Remove(collection.filePath(".wal.old"))
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Compact folds the write-ahead log into a new snapshot of the collection.
+// Only servers store collections on disk.
+func (collection *Collection) Compact() error {
+	if !collection.node.IsServer() {
+		return errors.New("Collections can only be compacted by the server")
+	}
+
+	return collection.compact()
+}
+
+// rotateLog moves the current write-ahead log to the .wal.old file
+// and opens a new, empty log. The caller must hold the file mutex.
+func (collection *Collection) rotateLog() error {
+	oldLogPath := collection.filePath(".wal.old")
+
+	// A previous compaction did not finish,
+	// keep appending to the current log.
+	_, err := os.Stat(oldLogPath)
+
+	if err == nil {
+		return nil
+	}
+
+	err = collection.log.Close()
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(collection.filePath(".wal"), oldLogPath)
+
+	if err != nil {
+		return err
+	}
+
+	return collection.openLog()
+}
+
+// openLog opens the write-ahead log for appending.
+// The caller must hold the file mutex.
+func (collection *Collection) openLog() error {
+	file, err := os.OpenFile(collection.filePath(".wal"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	collection.log = file
+	collection.logSize = stat.Size()
+
+	if collection.logSize > 0 {
+		return nil
+	}
+
+	// Every later modification will be recorded in the new log
+	collection.logCodec = collection.Codec()
+	writer := bufio.NewWriter(file)
+	err = writeFileHeader(writer, collection.logCodec)
+
+	if err != nil {
+		return err
+	}
+
+	err = writeLogFileRecord(writer, logHistory, strconv.FormatInt(time.Now().UnixNano(), 10), keyMetadata{}, nil)
+
+	if err != nil {
+		return err
+	}
+
+	err = writer.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	collection.logSize = int64(writer.Size() - writer.Available())
+	return nil
+}
+
+// logMetadata returns the key metadata stored in the log.
+func (collection *Collection) logMetadata(key string) keyMetadata {
+	metadata := keyMetadata{
+		expiresAt: collection.expiresAt(key),
+	}
+
+	changed, exists := collection.changes.Load(key)
+
+	if exists {
+		metadata.changed = changed.(int64)
+	}
+
+	deleted, exists := collection.tombstones.Load(key)
+
+	if exists {
+		metadata.deleted = deleted.(int64)
+	}
+
+	return metadata
+}
+
+// closeLog closes the write-ahead log.
+func (collection *Collection) closeLog() error {
+	collection.fileMutex.Lock()
+	defer collection.fileMutex.Unlock()
+
+	if collection.log == nil {
+		return nil
+	}
+
+	err := collection.log.Close()
+	collection.log = nil
+	return err
+}
+
+// replayLog applies the write-ahead log with the given extension on top of the loaded data.
+func (collection *Collection) replayLog(extension string) error {
+	filePath := collection.filePath(extension)
+	file, err := os.Open(filePath)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	valid, err := collection.readLogRecords(file)
+	closeErr := file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	// Cut off an incomplete record from an interrupted write
+	// so that new records are not appended to it.
+	stat, err := os.Stat(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() > valid {
+		return os.Truncate(filePath, valid)
+	}
+
+	return nil
+}
+
+// readLogRecords applies all complete log records from the file
+// and returns the number of bytes that were part of complete records.
+// New records will be appended with the codec of the log.
+func (collection *Collection) readLogRecords(file *os.File) (int64, error) {
+	reader := bufio.NewReader(file)
+
+	if hasFileHeader(reader) {
+		codec, headerSize, err := readFileHeader(reader)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		collection.logCodec = codec
+
+		return collection.readFileRecords(file, int64(headerSize), true, func(keyField []byte, metadataField []byte, value []byte) error {
+			operation, key, metadata, err := parseLogFileRecord(keyField, metadataField)
+
+			if err != nil {
+				return collection.skipDamaged(keyField, metadataField, value, err)
+			}
+
+			return collection.applyLogRecord(codec, collection.decode, operation, key, metadata, value)
+		})
+	}
+
+	codec, headerSize, err := readLegacyHeader(reader)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Logs in the legacy line format are replaced after loading
+	_, peekErr := reader.Peek(1)
+	collection.legacyFiles = collection.legacyFiles || peekErr == nil
+	collection.logCodec = codec
+	valid := int64(headerSize)
+
+	for {
+		operation, key, metadata, value, size, err := readLogRecord(reader, parseLegacyKeyLine)
+
+		// An incomplete record at the end of the log is the result of an interrupted write
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		}
+
+		if err != nil {
+			return valid, err
+		}
+
+		err = collection.applyLogRecord(codec, collection.unmarshalWith, operation, key, metadata, value)
+
+		if err != nil {
+			return valid, err
+		}
+
+		valid += int64(size)
+	}
+}
+
+// applyLogRecord applies a single record of the write-ahead log to the loaded data.
+func (collection *Collection) applyLogRecord(codec Codec, decode func(Codec, []byte) (interface{}, error), operation byte, key string, metadata keyMetadata, value []byte) error {
+	switch operation {
+	case logSet:
+		obj, err := decode(codec, value)
+
+		if err != nil {
+			return collection.skipDamaged([]byte(key), []byte(formatMetadata(metadata)), value, err)
+		}
+
+		collection.restore(key, obj, metadata)
+
+	case logDelete:
+		collection.restore(key, nil, metadata)
+
+	case logHistory:
+		// The oldest log determines the start of the known history
+		if collection.historyStart == 0 {
+			start, err := strconv.ParseInt(key, 10, 64)
+
+			if err != nil {
+				return err
+			}
+
+			collection.historyStart = start
+		}
+	}
+
+	return nil
+}
+
+// readLogRecord reads a single set or delete record and splits its key line with the parse function.
+// It returns io.ErrUnexpectedEOF if the record is incomplete.
+func readLogRecord(reader *bufio.Reader, parse func(string) (string, keyMetadata, error)) (operation byte, key string, metadata keyMetadata, value []byte, size int, err error) {
+	line, err := reader.ReadBytes('\n')
+
+	if err == io.EOF && len(line) > 0 {
+		return 0, "", keyMetadata{}, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return 0, "", keyMetadata{}, nil, 0, err
+	}
+
+	if len(line) < 2 {
+		return 0, "", keyMetadata{}, nil, 0, errors.New("Invalid log record")
+	}
+
+	operation = line[0]
+	size = len(line)
+	key, metadata, err = parse(string(line[1 : len(line)-1]))
+
+	if err != nil {
+		return 0, "", keyMetadata{}, nil, 0, err
+	}
+
+	switch operation {
+	case logSet:
+		value, err = reader.ReadBytes('\n')
+
+		if err == io.EOF {
+			return 0, "", keyMetadata{}, nil, 0, io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return 0, "", keyMetadata{}, nil, 0, err
+		}
+
+		size += len(value)
+		value = value[:len(value)-1]
+
+	case logDelete, logHistory:
+		// Delete and history records consist of the key line only.
+
+	default:
+		return 0, "", keyMetadata{}, nil, 0, errors.New("Invalid log operation")
+	}
+
+	return operation, key, metadata, value, size, nil
+}
+
+// writeLogRecord writes a single set or delete record to the log.
+// Only set records have a value.
+func writeLogRecord(writer *bufio.Writer, operation byte, key string, metadata keyMetadata, encoded []byte) error {
+	err := writer.WriteByte(operation)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.WriteString(keyLine(key, metadata))
+
+	if err != nil {
+		return err
+	}
+
+	err = writer.WriteByte('\n')
+
+	if err != nil {
+		return err
+	}
+
+	if operation != logSet {
+		return nil
+	}
+
+	_, err = writer.Write(encoded)
+
+	if err != nil {
+		return err
+	}
+
+	return writer.WriteByte('\n')
+}
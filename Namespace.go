@@ -1,6 +1,8 @@
 package nano
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"reflect"
@@ -15,11 +17,13 @@ type Namespace struct {
 	name               string
 	root               string
 	types              sync.Map
+	typeNames          sync.Map
+	codecs             sync.Map
 	node               *Node
 }
 
 // newNamespace is the internal function used to create a new namespace.
-func newNamespace(node *Node, name string) *Namespace {
+func newNamespace(node *Node, name string) (*Namespace, error) {
 	// Create namespace
 	namespace := &Namespace{
 		node: node,
@@ -31,16 +35,31 @@ func newNamespace(node *Node, name string) *Namespace {
 	err := os.MkdirAll(namespace.root, 0777)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return namespace
+	return namespace, nil
 }
 
 // RegisterTypes expects a list of pointers and will look up the types
 // of the given pointers. These types will be registered so that collections
 // can store data using the given type. Note that nil pointers are acceptable.
+// The collection name is the type name without the package.
+// It panics if two different types share the same name, use RegisterTypesE
+// to handle the error instead and RegisterTypeAs for one of the types.
 func (ns *Namespace) RegisterTypes(types ...interface{}) *Namespace {
+	err := ns.RegisterTypesE(types...)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return ns
+}
+
+// RegisterTypesE registers the types like RegisterTypes, but returns an error
+// if a collection name is already registered for a different type.
+func (ns *Namespace) RegisterTypesE(types ...interface{}) error {
 	// Convert example objects to their respective types
 	for _, example := range types {
 		typeInfo := reflect.TypeOf(example)
@@ -49,35 +68,162 @@ func (ns *Namespace) RegisterTypes(types ...interface{}) *Namespace {
 			typeInfo = typeInfo.Elem()
 		}
 
-		ns.types.Store(typeInfo.Name(), typeInfo)
+		err := ns.registerType(typeInfo.Name(), typeInfo)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RegisterTypeAs registers the type of the given pointer under an explicit collection name.
+// It panics if the name is already registered for a different type, use RegisterTypeAsE
+// to handle the error instead.
+func (ns *Namespace) RegisterTypeAs(name string, example interface{}) *Namespace {
+	err := ns.RegisterTypeAsE(name, example)
+
+	if err != nil {
+		panic(err)
 	}
 
 	return ns
 }
 
+// RegisterTypeAsE registers the type like RegisterTypeAs, but returns an error
+// if the name is already registered for a different type.
+func (ns *Namespace) RegisterTypeAsE(name string, example interface{}) error {
+	typeInfo := reflect.TypeOf(example)
+
+	if typeInfo.Kind() == reflect.Ptr {
+		typeInfo = typeInfo.Elem()
+	}
+
+	return ns.registerType(name, typeInfo)
+}
+
+// registerType registers the type under the collection name.
+// Registering the same type again is allowed.
+func (ns *Namespace) registerType(name string, typeInfo reflect.Type) error {
+	existing, loaded := ns.types.LoadOrStore(name, typeInfo)
+
+	if loaded && existing.(reflect.Type) != typeInfo {
+		return errors.New("Collection " + name + " is already registered for type " + typeName(existing.(reflect.Type)) + ", use RegisterTypeAs to register " + typeName(typeInfo))
+	}
+
+	ns.typeNames.Store(typeInfo, name)
+	return nil
+}
+
+// SetCodec sets the codec of the given collections or, without any collection names,
+// the default codec of the namespace. Loaded collections switch to the new codec immediately.
+// Files written with a custom codec can only be loaded after it has been set.
+func (ns *Namespace) SetCodec(codec Codec, collections ...string) *Namespace {
+	registerCodec(codec)
+
+	if len(collections) == 0 {
+		ns.codecs.Store("", codec)
+
+		ns.collections.Range(func(key, value interface{}) bool {
+			_, custom := ns.codecs.Load(key)
+
+			if value != nil && !custom {
+				value.(*Collection).SetCodec(codec)
+			}
+
+			return true
+		})
+
+		return ns
+	}
+
+	for _, name := range collections {
+		ns.codecs.Store(name, codec)
+		collection, loaded := ns.collections.Load(name)
+
+		if loaded && collection != nil {
+			collection.(*Collection).SetCodec(codec)
+		}
+	}
+
+	return ns
+}
+
+// codecFor returns the codec of the collection with the given name.
+func (ns *Namespace) codecFor(name string) Codec {
+	codec, exists := ns.codecs.Load(name)
+
+	if !exists {
+		codec, exists = ns.codecs.Load("")
+	}
+
+	if !exists {
+		return JSON()
+	}
+
+	return codec.(Codec)
+}
+
+// typeName returns the type name including the full package path.
+func typeName(typeInfo reflect.Type) string {
+	if typeInfo.PkgPath() == "" {
+		return typeInfo.String()
+	}
+
+	return typeInfo.PkgPath() + "." + typeInfo.Name()
+}
+
 // Collection returns the collection with the given name.
+// It panics if the collection can not be loaded, use CollectionE to handle the error instead.
 func (ns *Namespace) Collection(name string) *Collection {
+	collection, err := ns.CollectionE(name)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return collection
+}
+
+// CollectionE returns the collection with the given name
+// or an error if the collection can not be loaded.
+func (ns *Namespace) CollectionE(name string) (*Collection, error) {
+	return ns.collection(name, ns.node.config.Recovery)
+}
+
+// collection returns the collection with the given name and loads it if necessary.
+func (ns *Namespace) collection(name string, recovery bool) (*Collection, error) {
 	obj, loaded := ns.collections.LoadOrStore(name, nil)
 
 	if !loaded {
-		collection := newCollection(ns, name)
+		collection, err := newCollection(ns, name, recovery)
+
+		// Clients apply received modifications to loading collections
+		// until they can be found in the namespace
+		defer ns.collectionsLoading.Delete(name)
+
+		if err != nil {
+			ns.collections.Delete(name)
+			return nil, err
+		}
+
 		ns.collections.Store(name, collection)
-		return collection
+		return collection, nil
 	}
 
 	// Wait for existing collection load
 	for obj == nil {
 		time.Sleep(1 * time.Millisecond)
-		obj, _ = ns.collections.Load(name)
-	}
+		obj, loaded = ns.collections.Load(name)
 
-	return obj.(*Collection)
-}
+		// The other load failed, try again
+		if !loaded {
+			return ns.collection(name, recovery)
+		}
+	}
 
-// collectionLoading returns the collection that is currently being loaded.
-func (ns *Namespace) collectionLoading(name string) *Collection {
-	obj, _ := ns.collectionsLoading.Load(name)
-	return obj.(*Collection)
+	return obj.(*Collection), nil
 }
 
 // Get returns the value for the given key.
@@ -95,6 +241,17 @@ func (ns *Namespace) Set(collection string, key string, value interface{}) {
 	ns.Collection(collection).Set(key, value)
 }
 
+// SetE sets the value for the key and returns an error if it can not be stored.
+func (ns *Namespace) SetE(collection string, key string, value interface{}) error {
+	obj, err := ns.CollectionE(collection)
+
+	if err != nil {
+		return err
+	}
+
+	return obj.SetE(key, value)
+}
+
 // Delete deletes a key from the collection.
 func (ns *Namespace) Delete(collection string, key string) bool {
 	return ns.Collection(collection).Delete(key)
@@ -180,7 +337,12 @@ func (ns *Namespace) Prefetch() {
 		wg.Add(1)
 
 		go func(name string) {
-			ns.Collection(name)
+			_, err := ns.CollectionE(name)
+
+			if err != nil {
+				fmt.Println("Error loading collection", name, err)
+			}
+
 			wg.Done()
 		}(typeName)
 
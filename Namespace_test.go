@@ -115,7 +115,7 @@ func TestNamespaceAll(t *testing.T) {
 	}
 
 	assert.Equal(t, recordCount, count)
-	assert.True(t, db.Collection("User").Count() >= 0)
+	assert.Equal(t, int64(recordCount), db.Collection("User").Count())
 }
 
 func TestNamespaceClose(t *testing.T) {
@@ -5,15 +5,34 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"reflect"
+	"io"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/aerogo/cluster/client"
-	"github.com/aerogo/cluster/server"
 	"github.com/aerogo/packet"
-	jsoniter "github.com/json-iterator/go"
 )
 
+// errOutdatedPacket is returned for modifications that are older than the stored ones.
+var errOutdatedPacket = errors.New("Outdated packet")
+
+// diskError is returned for modifications that have been applied in memory
+// but could not be written to disk.
+type diskError struct {
+	err error
+}
+
+// Error returns the reason.
+func (err *diskError) Error() string {
+	return "Error writing modification to disk: " + err.err.Error()
+}
+
+// Unwrap returns the reason.
+func (err *diskError) Unwrap() error {
+	return err.err
+}
+
 // serverReadPacketsFromClient reads packets from clients on the server side.
 func serverReadPacketsFromClient(client *packet.Stream, node *Node) {
 	for msg := range client.Incoming {
@@ -24,54 +43,62 @@ func serverReadPacketsFromClient(client *packet.Stream, node *Node) {
 			namespaceName, _ := data.ReadString('\n')
 			namespaceName = strings.TrimSuffix(namespaceName, "\n")
 
-			namespace := node.Namespace(namespaceName)
-
 			collectionName, _ := data.ReadString('\n')
 			collectionName = strings.TrimSuffix(collectionName, "\n")
 
+			// Reconnecting clients only need the modifications since their last synchronization
+			since, _ := strconv.ParseInt(readLine(data), 10, 64)
+			lazy := readLine(data) == "lazy"
+
 			if node.verbose {
-				fmt.Println("COLLECTION REQUEST", client.Connection().RemoteAddr(), namespaceName+"."+collectionName)
+				fmt.Println("COLLECTION REQUEST", client.Connection().RemoteAddr(), namespaceName+"."+collectionName, since)
 			}
 
-			collection := namespace.Collection(collectionName)
-			buffer := bytes.Buffer{}
+			namespace, err := node.NamespaceE(namespaceName)
 
-			buffer.WriteString(namespace.name)
-			buffer.WriteByte('\n')
-
-			buffer.WriteString(collection.name)
-			buffer.WriteByte('\n')
+			if err != nil {
+				fmt.Println("Error answering collection request:", err)
+				endTransfer(client, namespaceName, collectionName, err)
+				continue
+			}
 
-			writer := bufio.NewWriter(&buffer)
-			err := collection.writeRecords(writer, false)
+			collection, err := namespace.CollectionE(collectionName)
 
 			if err != nil {
 				fmt.Println("Error answering collection request:", err)
+				endTransfer(client, namespaceName, collectionName, err)
 				continue
 			}
 
-			err = writer.Flush()
+			err = collection.sendTransfer(client, since, lazy)
 
 			if err != nil {
-				fmt.Println("Error calling writer.Flush() on collection request:", err)
+				fmt.Println("Error answering collection request:", err)
 				continue
 			}
 
-			client.Outgoing <- packet.New(packetCollectionResponse, buffer.Bytes())
-
 			if node.verbose {
 				fmt.Println("COLLECTION REQUEST ANSWERED", client.Connection().RemoteAddr())
 			}
 
-		case packetSet:
-			if networkSet(msg, node) == nil {
-				serverForwardPacket(node.Server(), client, msg)
+		case packetKeyRequest:
+			err := serverAnswerKeyRequest(client, msg, node)
+
+			if err != nil {
+				fmt.Println("Error answering key request:", err)
 			}
 
+		case packetListRequest:
+			serverAnswerListRequest(client, msg, node)
+
+		case packetSet:
+			serverForwardApplied(node, client, msg, networkSet(msg, node))
+
 		case packetDelete:
-			if networkDelete(msg, node) == nil {
-				serverForwardPacket(node.Server(), client, msg)
-			}
+			serverForwardApplied(node, client, msg, networkDelete(msg, node))
+
+		case packetBatch:
+			serverForwardApplied(node, client, msg, networkBatch(msg, node))
 
 		default:
 			fmt.Printf("Error: Unknown network packet type %d of length %d\n", msg.Type, msg.Length)
@@ -83,57 +110,59 @@ func serverReadPacketsFromClient(client *packet.Stream, node *Node) {
 	}
 }
 
+// serverForwardApplied forwards a modification to the other clients if it has been applied.
+// Modifications that could not be written to disk are still forwarded,
+// so that all nodes keep the same data in memory.
+func serverForwardApplied(node *Node, client *packet.Stream, msg *packet.Packet, err error) {
+	var diskErr *diskError
+
+	if errors.As(err, &diskErr) {
+		fmt.Println(err)
+		err = nil
+	}
+
+	if err == nil {
+		serverForwardPacket(node, client, msg)
+	}
+}
+
 // clientReadPacketsFromServer reads packets from the server on the client side.
 func clientReadPacketsFromServer(client *client.Node, node *Node) {
+	transfers := map[string]*transfer{}
+
 	for msg := range client.Stream.Incoming {
 		switch msg.Type {
-		case packetCollectionResponse:
-			data := bytes.NewBuffer(msg.Data)
+		case packetCollectionBegin, packetCollectionChunk, packetCollectionEnd:
+			clientReceiveTransfer(msg, node, transfers)
 
-			namespaceName, _ := data.ReadString('\n')
-			namespaceName = strings.TrimSuffix(namespaceName, "\n")
+		case packetSet, packetDelete, packetBatch, packetKeyResponse:
+			node.networkWorkerQueue <- msg
 
-			namespace := node.Namespace(namespaceName)
-
-			collectionName, _ := data.ReadString('\n')
-			collectionName = strings.TrimSuffix(collectionName, "\n")
+		case packetListResponse:
+			clientReceiveList(msg, node)
 
+		case packetResync:
 			if node.verbose {
-				fmt.Println("COLLECTION RESPONSE RECEIVED", client.Address(), namespaceName+"."+collectionName)
-			}
-
-			collection := namespace.collectionLoading(collectionName)
-			err := collection.readRecords(data)
-
-			if err != nil {
-				panic(err)
+				fmt.Println("[client] Resynchronizing", client.Address())
 			}
 
-			namespace.collectionsLoading.Delete(collectionName)
-			close(collection.loaded)
-
-		case packetSet, packetDelete:
-			node.networkWorkerQueue <- msg
+			// The server couldn't send us all modifications
+			node.resync()
 
 		case packetServerClose:
 			if node.verbose {
 				fmt.Println("[client] Server closed!", client.Address())
 			}
 
-			client.Close()
-
-			if node.verbose {
-				fmt.Println("[client] Reconnecting", client.Address())
-			}
-
-			err := client.Connect()
-
-			if err != nil {
-				fmt.Println("Error re-connecting to server:", err.Error())
+			// The new connection doesn't continue the running transfers
+			for name := range transfers {
+				interruptTransfer(transfers, name)
 			}
 
-			if node.verbose {
-				fmt.Println("[client] Reconnect finished!", client.Address())
+			// Packets that arrived after the close packet still need to be read,
+			// otherwise closing the connection would wait for them forever.
+			if atomic.CompareAndSwapInt32(&node.reconnecting, 0, 1) {
+				go clientReconnect(client, node)
 			}
 
 		default:
@@ -148,6 +177,30 @@ func clientReadPacketsFromServer(client *client.Node, node *Node) {
 	}
 }
 
+// clientReconnect closes the connection to the server and connects again.
+func clientReconnect(client *client.Node, node *Node) {
+	client.Close()
+
+	if node.verbose {
+		fmt.Println("[client] Reconnecting", client.Address())
+	}
+
+	err := client.Connect()
+
+	if err != nil {
+		fmt.Println("Error re-connecting to server:", err.Error())
+	}
+
+	atomic.StoreInt32(&node.reconnecting, 0)
+
+	// Fetch the modifications we missed and send our own
+	node.resync()
+
+	if node.verbose {
+		fmt.Println("[client] Reconnect finished!", client.Address())
+	}
+}
+
 // clientNetworkWorker runs in a separate goroutine and handles the set & delete packets.
 func clientNetworkWorker(node *Node) {
 	for msg := range node.networkWorkerQueue {
@@ -165,117 +218,261 @@ func clientNetworkWorker(node *Node) {
 			if err != nil {
 				fmt.Printf("nano: networkDelete failed: %s\n", err.Error())
 			}
+
+		case packetBatch:
+			err := networkBatch(msg, node)
+
+			if err != nil {
+				fmt.Printf("nano: networkBatch failed: %s\n", err.Error())
+			}
+
+		case packetKeyResponse:
+			err := networkKeyResponse(msg, node)
+
+			if err != nil {
+				fmt.Printf("nano: networkKeyResponse failed: %s\n", err.Error())
+			}
 		}
 	}
 }
 
 // networkSet performs a set operation based on the information in the network packet.
 func networkSet(msg *packet.Packet, db *Node) error {
-	data := bytes.NewBuffer(msg.Data)
+	collection, packetTime, data, err := db.packetCollection(msg)
 
-	packetTimeBuffer := make([]byte, 8)
-	_, err := data.Read(packetTimeBuffer)
+	if err != nil || collection == nil {
+		return err
+	}
 
-	if err != nil {
+	return collection.applySet(packetTime, data)
+}
+
+// networkDelete performs a delete operation based on the information in the network packet.
+func networkDelete(msg *packet.Packet, db *Node) error {
+	collection, packetTime, data, err := db.packetCollection(msg)
+
+	if err != nil || collection == nil {
 		return err
 	}
 
-	packetTime, err := packet.Int64FromBytes(packetTimeBuffer)
+	return collection.applyDelete(packetTime, data)
+}
 
-	if err != nil {
+// networkBatch performs all operations of a batch packet.
+func networkBatch(msg *packet.Packet, db *Node) error {
+	collection, packetTime, data, err := db.packetCollection(msg)
+
+	if err != nil || collection == nil {
 		return err
 	}
 
-	namespaceName := readLine(data)
-	namespace := db.Namespace(namespaceName)
+	return collection.applyBatch(packetTime, data)
+}
+
+// readPacketHeader reads the timestamp, the namespace and the collection
+// at the start of a set, delete or batch packet.
+func readPacketHeader(msg *packet.Packet) (packetTime int64, namespace string, collection string, data *bytes.Buffer, err error) {
+	data = bytes.NewBuffer(msg.Data)
 
-	collectionName := readLine(data)
-	collectionObj, exists := namespace.collections.Load(collectionName)
+	packetTimeBuffer := make([]byte, 8)
+	_, err = data.Read(packetTimeBuffer)
 
-	if !exists || collectionObj == nil {
-		return nil //errors.New("Received networkSet command on non-existing collection")
+	if err != nil {
+		return 0, "", "", nil, err
 	}
 
-	collection := collectionObj.(*Collection)
-	key := readLine(data)
+	packetTime, err = packet.Int64FromBytes(packetTimeBuffer)
 
-	jsonBytes, _ := data.ReadBytes('\n')
-	jsonBytes = bytes.TrimSuffix(jsonBytes, []byte("\n"))
+	if err != nil {
+		return 0, "", "", nil, err
+	}
 
-	value := reflect.New(collection.typ).Interface()
-	err = jsoniter.Unmarshal(jsonBytes, &value)
+	namespace = readLine(data)
+	collection = readLine(data)
+	return packetTime, namespace, collection, data, nil
+}
+
+// packetCollection returns the collection that a set, delete or batch packet modifies,
+// together with the packet time and the rest of the packet. The collection is nil
+// if the packet doesn't need to be applied now. Packets for a collection that is
+// still receiving its initial transfer are applied after the transfer.
+func (node *Node) packetCollection(msg *packet.Packet) (*Collection, int64, *bytes.Buffer, error) {
+	packetTime, namespaceName, collectionName, data, err := readPacketHeader(msg)
 
 	if err != nil {
-		return err
+		return nil, 0, nil, err
 	}
 
-	// Check timestamp
-	lastModificationObj, exists := collection.lastModification.Load(key)
+	namespace, err := node.NamespaceE(namespaceName)
+
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	obj, loading := namespace.collectionsLoading.Load(collectionName)
 
-	if exists {
-		lastModification := lastModificationObj.(int64)
+	if loading {
+		collection := obj.(*Collection)
 
-		if packetTime < lastModification {
-			return errors.New("Outdated packet")
+		if collection.deferPacket(msg) {
+			return nil, 0, nil, nil
 		}
+
+		return collection, packetTime, data, nil
 	}
 
-	// Perform the actual set
-	collection.set(key, value)
+	obj, exists := namespace.collections.Load(collectionName)
 
-	// Update last modification time
-	collection.lastModification.Store(key, packetTime)
+	if !exists || obj == nil {
+		return nil, 0, nil, nil
+	}
 
-	return nil
+	return obj.(*Collection), packetTime, data, nil
 }
 
-// networkDelete performs a delete operation based on the information in the network packet.
-func networkDelete(msg *packet.Packet, db *Node) error {
-	data := bytes.NewBuffer(msg.Data)
-
-	packetTimeBuffer := make([]byte, 8)
-	_, err := data.Read(packetTimeBuffer)
+// applySet performs the set operation of a network packet.
+func (collection *Collection) applySet(packetTime int64, data *bytes.Buffer) error {
+	key, metadata, err := parseKeyLine(readLine(data))
 
 	if err != nil {
 		return err
 	}
 
-	packetTime, err := packet.Int64FromBytes(packetTimeBuffer)
+	// Lazy clients only keep the keys they know up to date
+	if collection.ignores(key) {
+		return nil
+	}
+
+	encoded, _ := data.ReadBytes('\n')
+	encoded = bytes.TrimSuffix(encoded, []byte("\n"))
+
+	value, err := collection.unmarshal(encoded)
 
 	if err != nil {
 		return err
 	}
 
-	namespaceName := readLine(data)
-	namespace := db.Namespace(namespaceName)
+	lock := collection.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
 
-	collectionName := readLine(data)
-	collectionObj, exists := namespace.collections.Load(collectionName)
+	// Check timestamp
+	collection.node.clock.observe(packetTime)
 
-	if !exists || collectionObj == nil {
-		return nil //errors.New("Received networkDelete command on non-existing collection")
+	if collection.isOutdated(key, packetTime) {
+		return errOutdatedPacket
 	}
 
-	collection := collectionObj.(*Collection)
-	key := readLine(data)
+	// Perform the actual set
+	err = collection.set(key, value, metadata.expiresAt, packetTime, OriginRemote)
 
-	// Check timestamp
-	obj, exists := collection.lastModification.Load(key)
+	// Update last modification time
+	collection.lastModification.Store(key, packetTime)
 
-	if exists {
-		lastModification := obj.(int64)
+	if err != nil {
+		return &diskError{err: err}
+	}
 
-		if packetTime < lastModification {
-			return errors.New("Outdated packet")
-		}
+	return nil
+}
+
+// applyDelete performs the delete operation of a network packet.
+func (collection *Collection) applyDelete(packetTime int64, data *bytes.Buffer) error {
+	key := keyUnescaper.Replace(readLine(data))
+
+	// Lazy clients only keep the keys they know up to date
+	if collection.ignores(key) {
+		return nil
+	}
+
+	lock := collection.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Check timestamp
+	collection.node.clock.observe(packetTime)
+
+	if collection.isOutdated(key, packetTime) {
+		return errOutdatedPacket
 	}
 
 	// Perform the actual deletion
-	collection.delete(key)
+	err := collection.delete(key, packetTime, OriginRemote)
 
 	// Update last modification time
 	collection.lastModification.Store(key, packetTime)
 
+	if err != nil {
+		return &diskError{err: err}
+	}
+
+	return nil
+}
+
+// applyBatch performs all operations of a batch packet.
+// Every key is checked against its own modification time.
+func (collection *Collection) applyBatch(packetTime int64, data *bytes.Buffer) error {
+	reader := bufio.NewReader(data)
+
+	for {
+		operation, key, metadata, encoded, _, err := readLogRecord(reader, parseKeyLine)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if collection.ignores(key) {
+			continue
+		}
+
+		var value interface{}
+
+		if operation == logSet {
+			value, err = collection.unmarshal(encoded)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		// Records sent after a reconnect keep their original timestamp
+		timestamp := packetTime
+
+		if metadata.modified != 0 {
+			timestamp = metadata.modified
+		}
+
+		lock := collection.keyLock(key)
+		lock.Lock()
+		collection.node.clock.observe(timestamp)
+
+		if !collection.isOutdated(key, timestamp) {
+			collection.apply(key, value, metadata.expiresAt, timestamp, OriginRemote)
+
+			if collection.node.IsServer() {
+				collection.pending.Store(key, nil)
+			}
+
+			collection.lastModification.Store(key, timestamp)
+		}
+
+		lock.Unlock()
+	}
+
+	if !collection.node.IsServer() {
+		return nil
+	}
+
+	err := collection.persist()
+
+	if err != nil {
+		return &diskError{err: err}
+	}
+
 	return nil
 }
 
@@ -288,36 +485,60 @@ func serverOnConnect(node *Node) func(*packet.Stream) {
 			fmt.Println("[server] New client", stream.Connection().RemoteAddr())
 		}
 
+		node.peers.Store(stream, newPeer(stream, node.config.Forwarding))
+
 		// Start reading packets from the client
 		go serverReadPacketsFromClient(stream, node)
 	}
 }
 
+// serverOnDisconnect returns a function that can be used as a parameter
+// for the OnDisconnect method. It is called every time a client disconnects.
+func serverOnDisconnect(node *Node) func(*packet.Stream) {
+	return func(stream *packet.Stream) {
+		obj, exists := node.peers.LoadAndDelete(stream)
+
+		if exists {
+			obj.(*peer).close()
+		}
+	}
+}
+
 // serverForwardPacket forwards the packet from the given client to other clients.
-func serverForwardPacket(serverNode *server.Node, client *packet.Stream, msg *packet.Packet) {
+func serverForwardPacket(node *Node, client *packet.Stream, msg *packet.Packet) {
+	serverNode := node.Server()
 	fromRemoteClient := serverNode.IsRemoteAddress(client.Connection().RemoteAddr())
 
-	for targetClient := range serverNode.AllClients() {
+	node.forward(msg, func(target *peer) bool {
 		// Ignore the client who sent us the packet in the first place
-		if targetClient == client {
-			continue
+		if target.stream == client {
+			return false
 		}
 
 		// Do not send packets from remote clients to other remote clients.
 		// Every node is responsible for notifying other remote nodes about changes.
-		if fromRemoteClient && serverNode.IsRemoteAddress(targetClient.Connection().RemoteAddr()) {
-			continue
-		}
+		return !fromRemoteClient || !serverNode.IsRemoteAddress(target.stream.Connection().RemoteAddr())
+	})
+}
 
-		// Send packet
-		select {
-		case targetClient.Outgoing <- msg:
-			// Send successful.
-		default:
-			// Discard packet.
-			// TODO: Find a better solution to deal with this.
-		}
+// isOutdated reports whether a modification of the key with the given timestamp
+// is older than the last known modification or deletion. The caller must hold the key lock.
+func (collection *Collection) isOutdated(key string, timestamp int64) bool {
+	if timestamp < atomic.LoadInt64(&collection.cleared) {
+		return true
 	}
+
+	obj, exists := collection.lastModification.Load(key)
+
+	if !exists {
+		obj, exists = collection.tombstones.Load(key)
+	}
+
+	if !exists {
+		return false
+	}
+
+	return timestamp < obj.(int64)
 }
 
 // readLine reads a single line from the byte buffer and will not include the line break character.
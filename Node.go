@@ -7,6 +7,7 @@ import (
 	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aerogo/cluster"
@@ -21,56 +22,109 @@ var _ cluster.Node = (*Node)(nil)
 // Node represents a single database node in the cluster.
 type Node struct {
 	namespaces         sync.Map
+	peers              sync.Map
 	node               cluster.Node
 	server             *server.Node
 	client             *client.Node
 	config             Configuration
+	clock              *clock
 	ioSleepTime        time.Duration
 	networkWorkerQueue chan *packet.Packet
+	listings           sync.Map
+	listRequests       uint64
+	reconnecting       int32
+	droppedPackets     uint64
 	verbose            bool
 }
 
 // New starts up a new database node.
+// It panics if the node can not be started, use Open to handle the error instead.
 func New(config Configuration) *Node {
-	// Get user info to access the home directory
-	user, err := user.Current()
+	node, err := Open(config)
 
 	if err != nil {
 		panic(err)
 	}
 
+	return node
+}
+
+// Open starts up a new database node.
+func Open(config Configuration) (*Node, error) {
 	// Create Node
 	node := &Node{
 		config:             config,
+		clock:              newClock(config.NodeID),
 		ioSleepTime:        100 * time.Millisecond,
 		networkWorkerQueue: make(chan *packet.Packet, 8192),
 	}
 
 	if node.config.Directory == "" {
+		// Get user info to access the home directory
+		user, err := user.Current()
+
+		if err != nil {
+			return nil, err
+		}
+
 		node.config.Directory = path.Join(user.HomeDir, ".aero", "db")
 	}
 
+	err := node.config.Forwarding.validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if node.config.TombstoneHorizon == 0 {
+		node.config.TombstoneHorizon = defaultTombstoneHorizon
+	}
+
 	node.connect()
-	return node
+	return node, nil
 }
 
-// Namespace ...
+// Namespace returns the namespace with the given name.
+// It panics if the namespace can not be created, use NamespaceE to handle the error instead.
 func (node *Node) Namespace(name string) *Namespace {
+	namespace, err := node.NamespaceE(name)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return namespace
+}
+
+// NamespaceE returns the namespace with the given name
+// or an error if the namespace can not be created.
+func (node *Node) NamespaceE(name string) (*Namespace, error) {
 	obj, loaded := node.namespaces.LoadOrStore(name, nil)
 
 	if !loaded {
-		namespace := newNamespace(node, name)
+		namespace, err := newNamespace(node, name)
+
+		if err != nil {
+			node.namespaces.Delete(name)
+			return nil, err
+		}
+
 		node.namespaces.Store(name, namespace)
-		return namespace
+		return namespace, nil
 	}
 
 	// Wait for existing namespace load
 	for obj == nil {
 		time.Sleep(1 * time.Millisecond)
-		obj, _ = node.namespaces.Load(name)
+		obj, loaded = node.namespaces.Load(name)
+
+		// The other attempt failed, try again
+		if !loaded {
+			return node.NamespaceE(name)
+		}
 	}
 
-	return obj.(*Namespace)
+	return obj.(*Namespace), nil
 }
 
 // IsServer ...
@@ -85,7 +139,54 @@ func (node *Node) IsClosed() bool {
 
 // Broadcast ...
 func (node *Node) Broadcast(msg *packet.Packet) {
-	node.node.Broadcast(msg)
+	node.broadcast(msg)
+}
+
+// broadcast sends the packet to the other nodes and reports whether a client
+// could pass it on to the server. Servers handle slow clients with their forwarding policy.
+func (node *Node) broadcast(msg *packet.Packet) bool {
+	if node.IsServer() {
+		node.forward(msg, nil)
+		return true
+	}
+
+	// Modifications made while reconnecting are sent after the resynchronization
+	if atomic.LoadInt32(&node.reconnecting) == 1 {
+		return false
+	}
+
+	select {
+	case node.client.Stream.Outgoing <- msg:
+		// Send successful.
+		return true
+	default:
+		// The modification will be sent again after the next resynchronization.
+		atomic.AddUint64(&node.droppedPackets, 1)
+		return false
+	}
+}
+
+// DroppedPackets returns the number of packets that couldn't be sent to other nodes.
+func (node *Node) DroppedPackets() uint64 {
+	return atomic.LoadUint64(&node.droppedPackets)
+}
+
+// forward sends the packet to all clients except the given one
+// using the forwarding policy from the configuration.
+func (node *Node) forward(msg *packet.Packet, filter func(*peer) bool) {
+	node.peers.Range(func(_, obj interface{}) bool {
+		client := obj.(*peer)
+
+		if filter != nil && !filter(client) {
+			return true
+		}
+
+		if !client.send(msg, node.config.Forwarding) {
+			atomic.AddUint64(&node.droppedPackets, 1)
+		}
+
+		return true
+	})
 }
 
 // Server ...
@@ -119,12 +220,23 @@ func (node *Node) Close() {
 			fmt.Println("[server] broadcast close")
 		}
 
-		node.Broadcast(packet.New(packetServerClose, nil))
+		closeMsg := packet.New(packetServerClose, nil)
+
+		node.peers.Range(func(_, client interface{}) bool {
+			client.(*peer).sendLast(closeMsg)
+			return true
+		})
 	}
 
 	// Close cluster node
 	node.node.Close()
 
+	// Stop the goroutines of the remaining clients
+	node.peers.Range(func(stream, _ interface{}) bool {
+		serverOnDisconnect(node)(stream.(*packet.Stream))
+		return true
+	})
+
 	// Close namespaces
 	node.namespaces.Range(func(key, value interface{}) bool {
 		namespace := value.(*Namespace)
@@ -140,6 +252,7 @@ func (node *Node) connect() {
 	if node.node.IsServer() {
 		node.server = node.node.(*server.Node)
 		node.server.OnConnect(serverOnConnect(node))
+		node.server.OnDisconnect(serverOnDisconnect(node))
 	} else {
 		node.client = node.node.(*client.Node)
 		go clientReadPacketsFromServer(node.client, node)
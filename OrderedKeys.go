@@ -0,0 +1,268 @@
+package nano
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// skipListMaxLevel is the maximum height of the skip list towers.
+const skipListMaxLevel = 32
+
+// ScanOptions control the order and the window of ordered key scans.
+type ScanOptions struct {
+	// Reverse returns the keys in descending order.
+	Reverse bool
+
+	// Offset is the number of keys that are skipped.
+	Offset int
+
+	// Limit is the maximum number of keys returned, 0 means no limit.
+	Limit int
+}
+
+// orderedKeys is a skip list that keeps the keys of a collection sorted.
+type orderedKeys struct {
+	head   *skipListNode
+	tail   *skipListNode
+	level  int
+	length int
+	random *rand.Rand
+	mutex  sync.RWMutex
+}
+
+// skipListNode is a single key in the skip list.
+// The bottom level is linked in both directions for reverse scans.
+type skipListNode struct {
+	key  string
+	next []*skipListNode
+	prev *skipListNode
+}
+
+// newOrderedKeys creates an empty skip list.
+func newOrderedKeys() *orderedKeys {
+	return &orderedKeys{
+		head:   &skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level:  1,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// insert adds the key to the skip list.
+func (keys *orderedKeys) insert(key string) {
+	keys.mutex.Lock()
+	defer keys.mutex.Unlock()
+
+	update := make([]*skipListNode, skipListMaxLevel)
+	node := keys.head
+
+	for level := keys.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+
+		update[level] = node
+	}
+
+	if node.next[0] != nil && node.next[0].key == key {
+		return
+	}
+
+	height := keys.randomLevel()
+
+	for level := keys.level; level < height; level++ {
+		update[level] = keys.head
+	}
+
+	if height > keys.level {
+		keys.level = height
+	}
+
+	inserted := &skipListNode{
+		key:  key,
+		next: make([]*skipListNode, height),
+	}
+
+	for level := 0; level < height; level++ {
+		inserted.next[level] = update[level].next[level]
+		update[level].next[level] = inserted
+	}
+
+	if update[0] != keys.head {
+		inserted.prev = update[0]
+	}
+
+	if inserted.next[0] != nil {
+		inserted.next[0].prev = inserted
+	} else {
+		keys.tail = inserted
+	}
+
+	keys.length++
+}
+
+// remove deletes the key from the skip list.
+func (keys *orderedKeys) remove(key string) {
+	keys.mutex.Lock()
+	defer keys.mutex.Unlock()
+
+	update := make([]*skipListNode, skipListMaxLevel)
+	node := keys.head
+
+	for level := keys.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+
+		update[level] = node
+	}
+
+	removed := node.next[0]
+
+	if removed == nil || removed.key != key {
+		return
+	}
+
+	for level := 0; level < len(removed.next); level++ {
+		update[level].next[level] = removed.next[level]
+	}
+
+	if removed.next[0] != nil {
+		removed.next[0].prev = removed.prev
+	} else {
+		keys.tail = removed.prev
+	}
+
+	for keys.level > 1 && keys.head.next[keys.level-1] == nil {
+		keys.level--
+	}
+
+	keys.length--
+}
+
+// scan returns the keys k with start <= k < end.
+// An empty end means that there is no upper bound.
+// Keys for which skip returns true don't count towards the offset and the limit.
+func (keys *orderedKeys) scan(start string, end string, options ScanOptions, skip func(key string) bool) []string {
+	keys.mutex.RLock()
+	defer keys.mutex.RUnlock()
+
+	var node *skipListNode
+
+	if options.Reverse {
+		node = keys.last(end)
+	} else {
+		node = keys.first(start)
+	}
+
+	skipped := 0
+	result := []string{}
+
+	for node != nil {
+		if options.Reverse && node.key < start {
+			break
+		}
+
+		if !options.Reverse && end != "" && node.key >= end {
+			break
+		}
+
+		if !skip(node.key) {
+			if skipped < options.Offset {
+				skipped++
+			} else {
+				result = append(result, node.key)
+
+				if options.Limit > 0 && len(result) >= options.Limit {
+					break
+				}
+			}
+		}
+
+		if options.Reverse {
+			node = node.prev
+		} else {
+			node = node.next[0]
+		}
+	}
+
+	return result
+}
+
+// first returns the first node with a key greater than or equal to start.
+func (keys *orderedKeys) first(start string) *skipListNode {
+	node := keys.head
+
+	for level := keys.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < start {
+			node = node.next[level]
+		}
+	}
+
+	return node.next[0]
+}
+
+// last returns the last node with a key less than end.
+// An empty end returns the last node of the list.
+func (keys *orderedKeys) last(end string) *skipListNode {
+	if end == "" {
+		return keys.tail
+	}
+
+	node := keys.head
+
+	for level := keys.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < end {
+			node = node.next[level]
+		}
+	}
+
+	if node == keys.head {
+		return nil
+	}
+
+	return node
+}
+
+// randomLevel returns the height for a new node.
+func (keys *orderedKeys) randomLevel() int {
+	level := 1
+
+	for level < skipListMaxLevel && keys.random.Int63()&3 == 0 {
+		level++
+	}
+
+	return level
+}
+
+// Keys returns all keys of the collection in ascending order.
+// Expired keys are skipped, like in Range and Prefix.
+func (collection *Collection) Keys() []string {
+	return collection.keys.scan("", "", ScanOptions{}, collection.isExpired)
+}
+
+// Range returns the keys k with start <= k < end in the order and window given by the options.
+// An empty end means that there is no upper bound.
+func (collection *Collection) Range(start string, end string, options ScanOptions) []string {
+	return collection.keys.scan(start, end, options, collection.isExpired)
+}
+
+// Prefix returns the keys starting with the prefix in the order and window given by the options.
+func (collection *Collection) Prefix(prefix string, options ScanOptions) []string {
+	return collection.keys.scan(prefix, prefixEnd(prefix), options, collection.isExpired)
+}
+
+// prefixEnd returns the smallest string that is greater than all strings with the given prefix.
+// It returns an empty string if there is no such string.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
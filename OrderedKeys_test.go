@@ -0,0 +1,31 @@
+package nano_test
+
+import (
+	"testing"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestCollectionKeys(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Clear()
+
+	for _, key := range []string{"b:2", "a:1", "b:1", "c:1", "a:2", "b:3"} {
+		users.Set(key, newUser(1))
+	}
+
+	users.Delete("c:1")
+
+	assert.DeepEqual(t, []string{"a:1", "a:2", "b:1", "b:2", "b:3"}, users.Keys())
+	assert.DeepEqual(t, []string{"a:2", "b:1"}, users.Range("a:2", "b:2", nano.ScanOptions{}))
+	assert.DeepEqual(t, []string{"b:1", "b:2", "b:3"}, users.Prefix("b:", nano.ScanOptions{}))
+	assert.DeepEqual(t, []string{"b:2", "b:1"}, users.Prefix("b:", nano.ScanOptions{Reverse: true, Offset: 1}))
+	assert.DeepEqual(t, []string{"b:3", "b:2", "b:1", "a:2"}, users.Range("a:2", "", nano.ScanOptions{Reverse: true}))
+	assert.DeepEqual(t, []string{"a:2", "b:1"}, users.Range("", "", nano.ScanOptions{Offset: 1, Limit: 2}))
+	assert.DeepEqual(t, []string{}, users.Prefix("c:", nano.ScanOptions{}))
+}
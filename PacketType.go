@@ -2,8 +2,17 @@ package nano
 
 const (
 	packetCollectionRequest  = iota
-	packetCollectionResponse = iota
+	packetCollectionResponse = iota // Replaced by the begin, chunk and end packets
 	packetSet                = iota
 	packetDelete             = iota
 	packetServerClose        = iota
+	packetBatch              = iota
+	packetResync             = iota
+	packetCollectionBegin    = iota
+	packetCollectionChunk    = iota
+	packetCollectionEnd      = iota
+	packetKeyRequest         = iota
+	packetKeyResponse        = iota
+	packetListRequest        = iota
+	packetListResponse       = iota
 )
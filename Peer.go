@@ -0,0 +1,134 @@
+package nano
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/aerogo/packet"
+)
+
+// peer is a client connected to the server.
+type peer struct {
+	stream *packet.Stream
+	queue  chan *packet.Packet
+	queued int32
+	done   chan struct{}
+	stale  int32
+}
+
+// newPeer creates the server side state for a new client connection.
+func newPeer(stream *packet.Stream, forwarding Forwarding) *peer {
+	client := &peer{
+		stream: stream,
+		done:   make(chan struct{}),
+	}
+
+	if forwarding.Mode == ForwardingQueue {
+		client.queue = make(chan *packet.Packet, forwarding.QueueSize)
+		go client.replay()
+	}
+
+	return client
+}
+
+// send sends the packet to the client using the forwarding policy of the node
+// and reports whether the packet has been sent or queued.
+func (client *peer) send(msg *packet.Packet, forwarding Forwarding) bool {
+	switch forwarding.Mode {
+	case ForwardingQueue:
+		// All packets go through the queue to keep their order
+		atomic.AddInt32(&client.queued, 1)
+
+		select {
+		case client.queue <- msg:
+			return true
+		default:
+			atomic.AddInt32(&client.queued, -1)
+			return false
+		}
+
+	case ForwardingResync:
+		// The client will receive the modifications with its resynchronization
+		if atomic.LoadInt32(&client.stale) == 1 {
+			return false
+		}
+	}
+
+	select {
+	case client.stream.Outgoing <- msg:
+		return true
+	default:
+	}
+
+	switch forwarding.Mode {
+	case ForwardingBlock:
+		timer := time.NewTimer(forwarding.Timeout)
+		defer timer.Stop()
+
+		select {
+		case client.stream.Outgoing <- msg:
+			return true
+		case <-timer.C:
+		case <-client.done:
+		}
+
+	case ForwardingResync:
+		if atomic.CompareAndSwapInt32(&client.stale, 0, 1) {
+			go client.requestResync()
+		}
+	}
+
+	return false
+}
+
+// replay sends the queued packets to the client.
+func (client *peer) replay() {
+	for {
+		select {
+		case msg := <-client.queue:
+			select {
+			case client.stream.Outgoing <- msg:
+				atomic.AddInt32(&client.queued, -1)
+			case <-client.done:
+				return
+			}
+
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// requestResync tells the client to request the modifications it missed
+// as soon as there is space in its send buffer.
+func (client *peer) requestResync() {
+	select {
+	case client.stream.Outgoing <- packet.New(packetResync, nil):
+		// Packets from now on arrive after the resynchronization request
+		atomic.StoreInt32(&client.stale, 0)
+
+	case <-client.done:
+	}
+}
+
+// sendLast sends the packet after all queued packets regardless of the forwarding policy.
+// It is used for the last packet before the server closes.
+func (client *peer) sendLast(msg *packet.Packet) {
+	for atomic.LoadInt32(&client.queued) > 0 {
+		select {
+		case <-client.done:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	select {
+	case client.stream.Outgoing <- msg:
+	case <-client.done:
+	}
+}
+
+// close stops the goroutines of the peer.
+func (client *peer) close() {
+	close(client.done)
+}
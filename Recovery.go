@@ -0,0 +1,239 @@
+package nano
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// skipDamaged moves a damaged record to the .corrupt file in recovery mode.
+// Otherwise, it returns the reason so that loading the collection fails.
+// The .corrupt file contains the key, the metadata and the value as they were found,
+// stored in the record format of the binary file format. Records of the legacy line format
+// keep the whole key line in the key field. Damaged bytes that can't be split into records
+// are stored as a value with an empty key.
+func (collection *Collection) skipDamaged(key []byte, metadata []byte, value []byte, reason error) error {
+	if !collection.recovery {
+		return reason
+	}
+
+	atomic.AddInt64(&collection.corruptRecords, 1)
+
+	if key == nil {
+		fmt.Println("Skipping", len(value), "damaged bytes of collection", collection.name, reason)
+	} else {
+		fmt.Println("Skipping damaged record", strconv.Quote(string(key)), "of collection", collection.name, reason)
+	}
+
+	file, err := os.OpenFile(collection.filePath(".corrupt"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	err = writeRecord(writer, key, metadata, value)
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// CorruptRecords returns the number of damaged records that have been skipped
+// while loading the collection in recovery mode.
+func (collection *Collection) CorruptRecords() int64 {
+	return atomic.LoadInt64(&collection.corruptRecords)
+}
+
+// Repair loads the collection in recovery mode and rewrites its files without the damaged records,
+// which are moved to the .corrupt file. It returns the number of damaged records.
+// Collections that have already been loaded are only rewritten.
+func (node *Node) Repair(namespace string, collection string) (int64, error) {
+	if !node.IsServer() {
+		return 0, errors.New("Collections can only be repaired by the server")
+	}
+
+	ns, err := node.NamespaceE(namespace)
+
+	if err != nil {
+		return 0, err
+	}
+
+	obj, err := ns.collection(collection, true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = obj.compact()
+	return obj.CorruptRecords(), err
+}
+
+// recoverSnapshot cleans up after a snapshot swap that was interrupted by a crash.
+// writeSnapshot moves the .dat file to .tmp and the .new file to .dat, so
+// if the .dat file is missing, the newest complete leftover becomes the snapshot.
+func (collection *Collection) recoverSnapshot() error {
+	_, err := os.Stat(collection.filePath(".dat"))
+
+	if err == nil {
+		// The swap either didn't start or only the removal of the old snapshot is missing
+		return removeFiles(collection.filePath(".new"), collection.filePath(".tmp"))
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, extension := range []string{".new", ".tmp"} {
+		valid, err := validSnapshot(collection.filePath(extension))
+
+		if err != nil {
+			return err
+		}
+
+		// Damaged snapshots are only used in recovery mode
+		if !valid && (extension != ".tmp" || !collection.recovery) {
+			continue
+		}
+
+		err = os.Rename(collection.filePath(extension), collection.filePath(".dat"))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Recovered snapshot of collection", collection.name, "from", collection.name+extension)
+		err = syncDirectory(collection.ns.root)
+
+		if err != nil {
+			return err
+		}
+
+		return removeFiles(collection.filePath(".new"), collection.filePath(".tmp"))
+	}
+
+	_, err = os.Stat(collection.filePath(".tmp"))
+
+	if err == nil {
+		return errors.New("No complete snapshot of collection " + collection.name + " found, use Repair to load " + collection.name + ".tmp")
+	}
+
+	return nil
+}
+
+// validSnapshot reports whether the snapshot file is complete and undamaged.
+// Missing files are not valid.
+func validSnapshot(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	if !hasFileHeader(reader) {
+		return validLegacySnapshot(reader)
+	}
+
+	_, _, err = readFileHeader(reader)
+
+	if err != nil {
+		return false, nil
+	}
+
+	for {
+		_, _, _, _, err = readRecord(reader)
+
+		if err == io.EOF {
+			return true, nil
+		}
+
+		if err != nil {
+			return false, nil
+		}
+	}
+}
+
+// validLegacySnapshot reports whether a snapshot in the legacy line format
+// consists of complete key and value lines.
+func validLegacySnapshot(reader *bufio.Reader) (bool, error) {
+	_, _, err := readLegacyHeader(reader)
+
+	if err != nil {
+		return false, nil
+	}
+
+	lineCount := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if err == io.EOF {
+			return len(line) == 0 && lineCount%2 == 0, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		lineCount++
+	}
+}
+
+// removeFiles removes the files if they exist.
+func removeFiles(filePaths ...string) error {
+	for _, filePath := range filePaths {
+		err := os.Remove(filePath)
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncDirectory writes the directory entries to disk,
+// so that renamed files keep their new name after a crash.
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	closeErr := dir.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
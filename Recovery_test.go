@@ -0,0 +1,217 @@
+package nano_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+// damageSnapshot writes a snapshot of three users to the "corrupt" namespace
+// and damages the record of the first one.
+func damageSnapshot(t *testing.T) {
+	node := nano.New(config)
+	users := node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+
+	for _, key := range []string{"1", "2", "3"} {
+		users.Set(key, newUser(1))
+	}
+
+	users.SetCodec(nano.JSON())
+	node.Close()
+
+	// The log could still contain the records of the snapshot
+	assert.Nil(t, os.Remove(path.Join(namespaceDirectory("corrupt"), "User.wal")))
+
+	filePath := path.Join(namespaceDirectory("corrupt"), "User.dat")
+	snapshot, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+
+	index := strings.Index(string(snapshot), "Test User")
+	assert.True(t, index > 0)
+	snapshot[index] = 'B'
+	assert.Nil(t, ioutil.WriteFile(filePath, snapshot, 0644))
+}
+
+// removeCollectionFiles removes all files of the User collection in the namespace.
+func removeCollectionFiles(namespace string) {
+	for _, extension := range []string{".dat", ".wal", ".corrupt", ".new", ".tmp"} {
+		os.Remove(path.Join(namespaceDirectory(namespace), "User"+extension))
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	damageSnapshot(t)
+	defer removeCollectionFiles("corrupt")
+
+	recoveryConfig := config
+	recoveryConfig.Recovery = true
+
+	node := nano.New(recoveryConfig)
+	users := node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(1), users.CorruptRecords())
+	assert.False(t, users.Exists("1"))
+	assert.True(t, users.Exists("2"))
+	assert.True(t, users.Exists("3"))
+	node.Close()
+
+	corrupt, err := ioutil.ReadFile(path.Join(namespaceDirectory("corrupt"), "User.corrupt"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(corrupt), "Best User"))
+
+	// The damaged record has been removed from the snapshot
+	node = nano.New(config)
+	defer node.Close()
+
+	users, err = node.Namespace("corrupt").RegisterTypes(types...).CollectionE("User")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), users.Count())
+}
+
+func TestRepair(t *testing.T) {
+	damageSnapshot(t)
+	defer removeCollectionFiles("corrupt")
+
+	node := nano.New(config)
+	defer node.Close()
+
+	_, err := node.Namespace("corrupt").RegisterTypes(types...).CollectionE("User")
+	assert.NotNil(t, err)
+
+	corruptRecords, err := node.Repair("corrupt", "User")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), corruptRecords)
+
+	users := node.Namespace("corrupt").Collection("User")
+	assert.Equal(t, int64(2), users.Count())
+
+	// Loaded collections are only rewritten
+	corruptRecords, err = node.Repair("corrupt", "User")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), corruptRecords)
+}
+
+func TestRecoverInterruptedSwap(t *testing.T) {
+	defer removeCollectionFiles("corrupt")
+	directory := namespaceDirectory("corrupt")
+
+	node := nano.New(config)
+	users := node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	users.Set("1", newUser(1))
+	users.SetCodec(nano.JSON())
+	node.Close()
+
+	assert.Nil(t, os.Remove(path.Join(directory, "User.wal")))
+	snapshot, err := ioutil.ReadFile(path.Join(directory, "User.dat"))
+	assert.Nil(t, err)
+
+	// Crash after the old snapshot has been moved away while the new one is incomplete
+	assert.Nil(t, os.Rename(path.Join(directory, "User.dat"), path.Join(directory, "User.tmp")))
+	assert.Nil(t, ioutil.WriteFile(path.Join(directory, "User.new"), snapshot[:len(snapshot)-1], 0644))
+
+	node = nano.New(config)
+	users = node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.True(t, users.Exists("1"))
+	node.Close()
+
+	for _, extension := range []string{".new", ".tmp"} {
+		_, err = os.Stat(path.Join(directory, "User"+extension))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Crash after the old snapshot has been moved away while the new one is complete
+	assert.Nil(t, os.Remove(path.Join(directory, "User.wal")))
+	assert.Nil(t, os.Rename(path.Join(directory, "User.dat"), path.Join(directory, "User.new")))
+
+	node = nano.New(config)
+	defer node.Close()
+
+	users = node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.True(t, users.Exists("1"))
+}
+
+func TestRecoveryDamagedLength(t *testing.T) {
+	defer removeCollectionFiles("corrupt")
+	directory := namespaceDirectory("corrupt")
+
+	node := nano.New(config)
+	users := node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+
+	for _, key := range []string{"1", "2", "3"} {
+		users.Set(key, newUser(1))
+	}
+
+	users.SetCodec(nano.JSON())
+	node.Close()
+	assert.Nil(t, os.Remove(path.Join(directory, "User.wal")))
+
+	// Damage the key length of the first record in the snapshot
+	filePath := path.Join(directory, "User.dat")
+	snapshot, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+	snapshot[len("\x89NANO\x01\x04json")+1] = 0xff
+	assert.Nil(t, ioutil.WriteFile(filePath, snapshot, 0644))
+
+	recoveryConfig := config
+	recoveryConfig.Recovery = true
+
+	node = nano.New(recoveryConfig)
+	users = node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(1), users.CorruptRecords())
+	assert.False(t, users.Exists("1"))
+	assert.True(t, users.Exists("2"))
+	assert.True(t, users.Exists("3"))
+	node.Close()
+
+	// The unreadable bytes are kept in the .corrupt file
+	corrupt, err := ioutil.ReadFile(path.Join(directory, "User.corrupt"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(corrupt), "Test User"))
+
+	// Damage the key length of a record in the middle of the log
+	node = nano.New(config)
+	users = node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(2), users.Count())
+
+	for _, key := range []string{"4", "5", "6"} {
+		users.Set(key, newUser(1))
+	}
+
+	node.Close()
+
+	filePath = path.Join(directory, "User.wal")
+	log, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+	// The first of the new records is followed by the others
+	damagedKey := ""
+	index := len(log)
+
+	for _, key := range []string{"4", "5", "6"} {
+		position := strings.Index(string(log), "+"+key)
+
+		if position > 4 && position < index {
+			damagedKey = key
+			index = position
+		}
+	}
+
+	log[index-3] = 0xff
+	assert.Nil(t, ioutil.WriteFile(filePath, log, 0644))
+
+	node = nano.New(config)
+	_, err = node.Namespace("corrupt").RegisterTypes(types...).CollectionE("User")
+	assert.NotNil(t, err)
+	node.Close()
+
+	node = nano.New(recoveryConfig)
+	defer node.Close()
+
+	users = node.Namespace("corrupt").RegisterTypes(types...).Collection("User")
+	assert.Equal(t, int64(1), users.CorruptRecords())
+	assert.Equal(t, int64(4), users.Count())
+	assert.False(t, users.Exists(damagedKey))
+}
@@ -0,0 +1,380 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aerogo/packet"
+)
+
+// Kinds of collection transfers.
+const (
+	// transferFull contains all records of the collection.
+	transferFull = "full"
+
+	// transferDelta contains the log records of all keys modified since the requested time.
+	transferDelta = "delta"
+
+	// transferKeys has no records. It tells lazy clients to fetch the keys they know again,
+	// because the history of the server doesn't reach back to the requested time.
+	transferKeys = "keys"
+)
+
+// request asks the server for the collection data.
+// A time of 0 requests the full collection, otherwise only
+// the modifications since the given server time are requested.
+func (collection *Collection) request(since int64) {
+	packetData := bytes.Buffer{}
+	fmt.Fprintf(&packetData, "%s\n%s\n%d\n", collection.ns.name, collection.name, since)
+
+	// Lazy clients never receive the full collection
+	if collection.lazy {
+		fmt.Fprintf(&packetData, "lazy\n")
+	}
+
+	collection.node.Client().Stream.Outgoing <- packet.New(packetCollectionRequest, packetData.Bytes())
+}
+
+// writeTransfer writes the response to a collection request.
+// The server answers with a delta if its history reaches back to the requested time,
+// otherwise it falls back to a full transfer or, for lazy clients, to a list of no keys.
+func (collection *Collection) writeTransfer(writer *bufio.Writer, since int64, lazy bool) error {
+	// Modifications made while the records are written will be sent again next time
+	serverTime := time.Now().UnixNano()
+	mode := transferFull
+
+	if since != 0 && since >= atomic.LoadInt64(&collection.historyStart) {
+		mode = transferDelta
+	} else if lazy {
+		mode = transferKeys
+	}
+
+	codec := collection.Codec()
+	_, err := fmt.Fprintf(writer, "%s %d %s\n", mode, serverTime, codec.Name())
+
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case transferDelta:
+		return collection.writeChanges(writer, codec, since)
+
+	case transferKeys:
+		return nil
+	}
+
+	return collection.writeRecords(writer, codec, false, true)
+}
+
+// writeChanges writes a log record for every key that has been modified since the given server time.
+func (collection *Collection) writeChanges(writer *bufio.Writer, codec Codec, since int64) error {
+	var err error
+
+	collection.changes.Range(func(key, changed interface{}) bool {
+		if changed.(int64) < since {
+			return true
+		}
+
+		metadata := keyMetadata{
+			modified: collection.modificationTime(key.(string)),
+		}
+
+		value, exists := collection.data.Load(key)
+
+		if !exists || collection.isExpired(key.(string)) {
+			err = writeLogRecord(writer, logDelete, key.(string), metadata, nil)
+			return err == nil
+		}
+
+		encoded, encodeErr := encodeValue(codec, value)
+
+		if encodeErr != nil {
+			fmt.Println("Error encoding key", key, "of collection", collection.name, encodeErr)
+			return true
+		}
+
+		metadata.expiresAt = collection.expiresAt(key.(string))
+		err = writeLogRecord(writer, logSet, key.(string), metadata, encoded)
+		return err == nil
+	})
+
+	return err
+}
+
+// parseTransferHeader returns the kind of the transfer, the server time it has been created at
+// and the codec of the values. The codec is nil if the server didn't send its name.
+func parseTransferHeader(line string) (string, int64, Codec, error) {
+	fields := strings.Fields(line)
+
+	if len(fields) < 2 || len(fields) > 3 || (fields[0] != transferFull && fields[0] != transferDelta && fields[0] != transferKeys) {
+		return "", 0, nil, errors.New("Invalid collection transfer header: " + line)
+	}
+
+	serverTime, err := strconv.ParseInt(fields[1], 10, 64)
+
+	if err != nil || len(fields) == 2 {
+		return fields[0], serverTime, nil, err
+	}
+
+	codec, err := codecByName(fields[2])
+	return fields[0], serverTime, codec, err
+}
+
+// modificationTime returns the timestamp of the last known modification of the key.
+// Servers fall back to the time they recorded the modification at.
+func (collection *Collection) modificationTime(key string) int64 {
+	modified, exists := collection.lastModification.Load(key)
+
+	if exists {
+		return modified.(int64)
+	}
+
+	deleted, exists := collection.tombstones.Load(key)
+
+	if exists {
+		return deleted.(int64)
+	}
+
+	changed, exists := collection.changes.Load(key)
+
+	if exists {
+		return changed.(int64)
+	}
+
+	return 0
+}
+
+// markUnsynced remembers a local modification of a client that couldn't be sent
+// to the server, so that it is sent after the next reconnect.
+func (collection *Collection) markUnsynced(key string, timestamp int64) {
+	if collection.node.IsServer() {
+		return
+	}
+
+	collection.unsynced.Store(key, timestamp)
+}
+
+// resync applies a collection transfer requested after a reconnect
+// and sends the local modifications the server might have missed.
+func (collection *Collection) resync(mode string, serverTime int64, data io.Reader) error {
+	switch mode {
+	case transferDelta:
+		reader := bufio.NewReader(data)
+
+		for {
+			operation, key, metadata, encoded, _, err := readLogRecord(reader, parseKeyLine)
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return err
+			}
+
+			var value interface{}
+
+			if operation == logSet {
+				value, err = collection.unmarshal(encoded)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			collection.resyncKey(key, value, metadata)
+		}
+
+	case transferFull:
+		received := map[string]struct{}{}
+
+		err := collection.forEachRecord(data, collection.Codec(), parseKeyLine, func(key string, value interface{}, metadata keyMetadata) {
+			received[key] = struct{}{}
+			collection.resyncKey(key, value, metadata)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// Keys missing in the transfer have been deleted on the server
+		collection.data.Range(func(key, _ interface{}) bool {
+			_, exists := received[key.(string)]
+
+			if !exists {
+				collection.resyncKey(key.(string), nil, keyMetadata{})
+			}
+
+			return true
+		})
+
+	case transferKeys:
+		collection.refetch()
+	}
+
+	collection.pushUnsynced()
+	atomic.StoreInt64(&collection.lastSeen, serverTime)
+	return nil
+}
+
+// resyncKey applies the state of the key on the server
+// unless there is a newer local modification.
+func (collection *Collection) resyncKey(key string, value interface{}, metadata keyMetadata) {
+	if collection.ignores(key) {
+		return
+	}
+
+	if metadata.expiresAt != 0 && metadata.expiresAt <= time.Now().UnixNano() {
+		value = nil
+	}
+
+	lock := collection.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, unsynced := collection.unsynced.Load(key)
+
+	if unsynced {
+		local := collection.modificationTime(key)
+
+		// The server already knows our modification
+		if metadata.modified == local {
+			collection.unsynced.Delete(key)
+			return
+		}
+
+		// Our modification is newer and will be sent to the server.
+		// Values without a modification time can't be ordered, so the server keeps them.
+		if metadata.modified < local && (metadata.modified != 0 || value == nil) {
+			return
+		}
+
+		collection.unsynced.Delete(key)
+	}
+
+	collection.node.clock.observe(metadata.modified)
+
+	// A newer modification has already been received
+	if metadata.modified != 0 && collection.isOutdated(key, metadata.modified) {
+		return
+	}
+
+	collection.apply(key, value, metadata.expiresAt, metadata.modified, OriginRemote)
+
+	if metadata.modified != 0 {
+		collection.lastModification.Store(key, metadata.modified)
+	}
+}
+
+// pushUnsynced sends all local modifications that couldn't be sent before
+// to the server in a single batch. Every record keeps its original timestamp.
+// The keys are only forgotten if the batch could be sent.
+func (collection *Collection) pushUnsynced() {
+	now := collection.node.clock.now()
+	buffer := bytes.Buffer{}
+	buffer.Write(packet.Int64ToBytes(now))
+	buffer.WriteString(collection.ns.name)
+	buffer.WriteByte('\n')
+	buffer.WriteString(collection.name)
+	buffer.WriteByte('\n')
+
+	writer := bufio.NewWriter(&buffer)
+	pushed := map[interface{}]interface{}{}
+
+	collection.unsynced.Range(func(key, timestamp interface{}) bool {
+		lock := collection.keyLock(key.(string))
+		lock.Lock()
+		defer lock.Unlock()
+
+		metadata := keyMetadata{
+			modified: collection.modificationTime(key.(string)),
+		}
+
+		if metadata.modified == 0 {
+			collection.unsynced.CompareAndDelete(key, timestamp)
+			return true
+		}
+
+		value, exists := collection.data.Load(key)
+		var err error
+
+		if exists {
+			encoded, encodeErr := collection.marshal(value)
+
+			if encodeErr != nil {
+				fmt.Println("Error encoding key", key, "of collection", collection.name, encodeErr)
+				return true
+			}
+
+			metadata.expiresAt = collection.expiresAt(key.(string))
+			err = writeLogRecord(writer, logSet, key.(string), metadata, encoded)
+		} else {
+			err = writeLogRecord(writer, logDelete, key.(string), metadata, nil)
+		}
+
+		if err != nil {
+			fmt.Println("Error encoding key", key, "of collection", collection.name, err)
+			return true
+		}
+
+		pushed[key] = timestamp
+		return true
+	})
+
+	if len(pushed) == 0 {
+		return
+	}
+
+	err := writer.Flush()
+
+	if err != nil {
+		fmt.Println("Error sending modifications of collection", collection.name, err)
+		return
+	}
+
+	if !collection.node.broadcast(packet.New(packetBatch, buffer.Bytes())) {
+		return
+	}
+
+	// Keys modified again in the meantime stay marked
+	for key, timestamp := range pushed {
+		collection.unsynced.CompareAndDelete(key, timestamp)
+	}
+}
+
+// resync requests the modifications of all loaded collections from the server
+// after a reconnect.
+func (node *Node) resync() {
+	node.namespaces.Range(func(_, obj interface{}) bool {
+		if obj == nil {
+			return true
+		}
+
+		obj.(*Namespace).collections.Range(func(_, collection interface{}) bool {
+			if collection == nil {
+				return true
+			}
+
+			lastSeen := atomic.LoadInt64(&collection.(*Collection).lastSeen)
+
+			// Lazy clients that haven't received any key only need to send their own
+			if collection.(*Collection).lazy && lastSeen == 0 {
+				collection.(*Collection).pushUnsynced()
+				return true
+			}
+
+			collection.(*Collection).request(lastSeen)
+			return true
+		})
+
+		return true
+	})
+}
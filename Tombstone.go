@@ -0,0 +1,92 @@
+package nano
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultTombstoneHorizon is the time deleted keys are remembered
+// if the configuration doesn't specify it.
+const defaultTombstoneHorizon = 7 * 24 * time.Hour
+
+// storeTombstone remembers a deletion that has been read from disk or received
+// in a collection transfer. Only servers store tombstones on disk, clients use
+// the deletion time to reject older modifications while they are running.
+func (collection *Collection) storeTombstone(key string, deleted int64) {
+	if collection.node.IsServer() {
+		collection.tombstones.Store(key, deleted)
+		return
+	}
+
+	collection.lastModification.Store(key, deleted)
+}
+
+// collectTombstones forgets the deletions that are older than the tombstone horizon.
+// Clients that have been offline for a longer time can't receive these deletions
+// anymore, so they will request the full collection on their next resynchronization.
+func (collection *Collection) collectTombstones() {
+	horizon := time.Now().Add(-collection.node.config.TombstoneHorizon).UnixNano()
+	collected := false
+
+	collection.tombstones.Range(func(key, deleted interface{}) bool {
+		if deleted.(int64) >= horizon {
+			return true
+		}
+
+		lock := collection.keyLock(key.(string))
+		lock.Lock()
+
+		// The key might have been modified in the meantime
+		if collection.tombstones.CompareAndDelete(key, deleted) {
+			collection.lastModification.CompareAndDelete(key, deleted)
+			collection.changes.Delete(key)
+			collected = true
+		}
+
+		lock.Unlock()
+		return true
+	})
+
+	if collected {
+		collection.advanceHistory(horizon)
+	}
+}
+
+// advanceHistory moves the start of the known history forward to the given server time.
+func (collection *Collection) advanceHistory(start int64) {
+	for {
+		historyStart := atomic.LoadInt64(&collection.historyStart)
+
+		if historyStart >= start || atomic.CompareAndSwapInt64(&collection.historyStart, historyStart, start) {
+			return
+		}
+	}
+}
+
+// storeCleared remembers the time of a Clear, unless a later one is already known.
+func (collection *Collection) storeCleared(cleared int64) {
+	for {
+		old := atomic.LoadInt64(&collection.cleared)
+
+		if old >= cleared || atomic.CompareAndSwapInt64(&collection.cleared, old, cleared) {
+			return
+		}
+	}
+}
+
+// forget removes the tombstone and the timestamps of the key if the Clear
+// at the given time already rejects all older modifications. The caller must hold the key lock.
+func (collection *Collection) forget(key string, cleared int64) {
+	deleted, exists := collection.tombstones.Load(key)
+
+	if exists && deleted.(int64) <= cleared {
+		collection.tombstones.Delete(key)
+		collection.changes.Delete(key)
+	}
+
+	modified, exists := collection.lastModification.Load(key)
+
+	if exists && modified.(int64) <= cleared {
+		collection.lastModification.Delete(key)
+	}
+}
@@ -0,0 +1,97 @@
+package nano_test
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestCollectionTombstones(t *testing.T) {
+	node := nano.New(config)
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Set("zombie", newUser(1))
+	users.Delete("zombie")
+
+	// The compaction keeps the tombstone in the snapshot
+	assert.Nil(t, users.Compact())
+	node.Close()
+
+	snapshot, err := ioutil.ReadFile(path.Join(namespaceDirectory("test"), "User.dat"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(snapshot), "zombie"))
+	assert.True(t, strings.Contains(string(snapshot), "deleted="))
+
+	// Tombstones older than the horizon are removed by the next compaction
+	horizonConfig := config
+	horizonConfig.TombstoneHorizon = time.Millisecond
+
+	node = nano.New(horizonConfig)
+	users = node.Namespace("test").RegisterTypes(types...).Collection("User")
+	assert.False(t, users.Exists("zombie"))
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, users.Compact())
+	node.Close()
+
+	snapshot, err = ioutil.ReadFile(path.Join(namespaceDirectory("test"), "User.dat"))
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(string(snapshot), "zombie"))
+}
+
+func TestCollectionClearTombstone(t *testing.T) {
+	server := nano.New(config)
+	client := nano.New(config)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Namespace("test").RegisterTypes(types...).Collection("User")
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	// The modification is older than the Clear on the restarted server
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+	clientUsers.Set("offline", newUser(1))
+
+	server = nano.New(config)
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+	serverUsers.Set("1", newUser(1))
+	serverUsers.Set("2", newUser(2))
+	serverUsers.Clear()
+	server.Close()
+
+	// A single record replaces the tombstones of all keys
+	snapshot, err := ioutil.ReadFile(path.Join(namespaceDirectory("test"), "User.dat"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(snapshot), "cleared="))
+	assert.False(t, strings.Contains(string(snapshot), "deleted="))
+
+	// The client sends its modification after the next restart
+	server = nano.New(config)
+	serverUsers = server.Namespace("test").RegisterTypes(types...).Collection("User")
+	start := time.Now()
+
+	for !serverUsers.Exists("online") {
+		clientUsers.Set("online", newUser(2))
+		time.Sleep(10 * time.Millisecond)
+
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("Client has not been resynchronized")
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, serverUsers.Exists("offline"))
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
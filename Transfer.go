@@ -0,0 +1,313 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aerogo/packet"
+)
+
+// transferChunkSize is the size of the chunks a collection transfer is split into.
+const transferChunkSize = 64 * 1024
+
+// TransferProgress describes how much of a collection a client has received from the server.
+type TransferProgress struct {
+	Namespace  string
+	Collection string
+
+	// Bytes is the number of bytes received so far.
+	Bytes int64
+
+	// Done is true when the whole collection has been received.
+	Done bool
+}
+
+// transfer is a collection transfer that is being received by a client.
+type transfer struct {
+	writer   *io.PipeWriter
+	done     chan struct{}
+	progress TransferProgress
+	node     *Node
+}
+
+// chunkWriter sends everything written to it as chunks of a collection transfer.
+type chunkWriter struct {
+	stream *packet.Stream
+	header []byte
+}
+
+// Write sends the data in a single chunk.
+func (writer *chunkWriter) Write(data []byte) (int, error) {
+	chunk := make([]byte, 0, len(writer.header)+len(data))
+	chunk = append(chunk, writer.header...)
+	chunk = append(chunk, data...)
+	writer.stream.Outgoing <- packet.New(packetCollectionChunk, chunk)
+	return len(data), nil
+}
+
+// transferHeader returns the prefix of all packets belonging to the transfer of a collection.
+func transferHeader(namespace string, collection string) []byte {
+	return []byte(namespace + "\n" + collection + "\n")
+}
+
+// sendTransfer streams the response to a collection request to the client.
+// The records are sent in chunks, so the server never needs to hold
+// a copy of the whole collection in memory.
+func (collection *Collection) sendTransfer(stream *packet.Stream, since int64, lazy bool) error {
+	stream.Outgoing <- packet.New(packetCollectionBegin, transferHeader(collection.ns.name, collection.name))
+
+	chunks := &chunkWriter{
+		stream: stream,
+		header: transferHeader(collection.ns.name, collection.name),
+	}
+
+	writer := bufio.NewWriterSize(chunks, transferChunkSize)
+	err := collection.writeTransfer(writer, since, lazy)
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	endTransfer(stream, collection.ns.name, collection.name, err)
+	return err
+}
+
+// endTransfer tells the client that the transfer of the collection is complete.
+// The client receives the error message if the transfer failed.
+func endTransfer(stream *packet.Stream, namespace string, collection string, err error) {
+	data := transferHeader(namespace, collection)
+
+	if err != nil {
+		data = append(data, err.Error()...)
+	}
+
+	stream.Outgoing <- packet.New(packetCollectionEnd, data)
+}
+
+// clientReceiveTransfer passes the packets of a collection transfer
+// to the goroutine that applies the received records.
+func clientReceiveTransfer(msg *packet.Packet, node *Node, transfers map[string]*transfer) {
+	data := bytes.NewBuffer(msg.Data)
+	namespaceName := readLine(data)
+	collectionName := readLine(data)
+	name := namespaceName + "." + collectionName
+	incoming, exists := transfers[name]
+
+	// The previous transfer has been interrupted by a reconnect
+	if exists && msg.Type == packetCollectionBegin {
+		interruptTransfer(transfers, name)
+		exists = false
+	}
+
+	if !exists {
+		incoming = newTransfer(node, namespaceName, collectionName)
+		transfers[name] = incoming
+	}
+
+	switch msg.Type {
+	case packetCollectionChunk:
+		incoming.receive(data.Bytes())
+
+	case packetCollectionEnd:
+		delete(transfers, name)
+		incoming.end(data.String())
+
+		if node.verbose {
+			fmt.Println("COLLECTION RESPONSE RECEIVED", name)
+		}
+	}
+}
+
+// interruptTransfer ends a transfer that will never be completed.
+func interruptTransfer(transfers map[string]*transfer, name string) {
+	transfers[name].end("Collection transfer of " + name + " has been interrupted")
+	delete(transfers, name)
+}
+
+// newTransfer starts a goroutine that applies the records
+// of the collection while they are being received.
+func newTransfer(node *Node, namespaceName string, collectionName string) *transfer {
+	reader, writer := io.Pipe()
+
+	incoming := &transfer{
+		writer: writer,
+		done:   make(chan struct{}),
+		node:   node,
+		progress: TransferProgress{
+			Namespace:  namespaceName,
+			Collection: collectionName,
+		},
+	}
+
+	go func() {
+		err := node.receiveCollection(namespaceName, collectionName, reader)
+
+		// Discard the remaining chunks
+		reader.CloseWithError(err)
+		close(incoming.done)
+	}()
+
+	return incoming
+}
+
+// receive passes a chunk to the goroutine applying the records.
+func (incoming *transfer) receive(chunk []byte) {
+	// Write only fails if the records have been discarded
+	_, _ = incoming.writer.Write(chunk)
+	incoming.progress.Bytes += int64(len(chunk))
+	incoming.report()
+}
+
+// end waits until all records have been applied.
+// A non-empty error message means that the server couldn't send the whole collection.
+func (incoming *transfer) end(errorMessage string) {
+	if errorMessage != "" {
+		incoming.writer.CloseWithError(errors.New(errorMessage))
+	} else {
+		incoming.writer.Close()
+	}
+
+	<-incoming.done
+	incoming.progress.Done = true
+	incoming.report()
+}
+
+// report calls the progress function of the configuration.
+func (incoming *transfer) report() {
+	if incoming.node.config.Progress != nil {
+		incoming.node.config.Progress(incoming.progress)
+	}
+}
+
+// receiveCollection applies a collection transfer. Clients that are loading
+// the collection use it as their initial data, otherwise the collection
+// is resynchronized with the transfer. Clients switch to the codec of the server.
+func (node *Node) receiveCollection(namespaceName string, collectionName string, stream io.Reader) error {
+	namespace, err := node.NamespaceE(namespaceName)
+
+	if err != nil {
+		fmt.Println("Error reading collection transfer:", err)
+		return err
+	}
+
+	reader := bufio.NewReader(stream)
+	header, err := reader.ReadString('\n')
+	var mode string
+	var serverTime int64
+	var codec Codec
+
+	if err == nil {
+		mode, serverTime, codec, err = parseTransferHeader(strings.TrimSuffix(header, "\n"))
+	}
+
+	obj, loading := namespace.collectionsLoading.Load(collectionName)
+
+	if loading && !obj.(*Collection).isLoaded() {
+		collection := obj.(*Collection)
+
+		// The error is reported to the goroutine waiting for the collection
+		if err == nil {
+			collection.useCodec(codec)
+			err = collection.readRecords(reader)
+		}
+
+		// Modifications that arrived during the transfer are newer than its records
+		if err == nil {
+			collection.applyDeferred()
+		}
+
+		collection.loadError = err
+		atomic.StoreInt64(&collection.lastSeen, serverTime)
+		close(collection.loaded)
+		return err
+	}
+
+	if err != nil {
+		fmt.Println("Error reading collection transfer:", err)
+		return err
+	}
+
+	obj, exists := namespace.collections.Load(collectionName)
+
+	if !exists || obj == nil {
+		return nil
+	}
+
+	obj.(*Collection).useCodec(codec)
+	err = obj.(*Collection).resync(mode, serverTime, reader)
+
+	if err != nil {
+		fmt.Println("Error resynchronizing collection", collectionName, err)
+	}
+
+	return err
+}
+
+// useCodec switches the collection to the codec of a transfer,
+// so that the values sent by the client can be decoded by the server.
+func (collection *Collection) useCodec(codec Codec) {
+	if codec != nil && codec.Name() != collection.Codec().Name() {
+		collection.SetCodec(codec)
+	}
+}
+
+// deferPacket keeps a set, delete or batch packet that arrived while the collection
+// is receiving its initial transfer. It returns false if the transfer has already been applied.
+func (collection *Collection) deferPacket(msg *packet.Packet) bool {
+	collection.deferredMutex.Lock()
+	defer collection.deferredMutex.Unlock()
+
+	if !collection.deferring {
+		return false
+	}
+
+	collection.deferred = append(collection.deferred, msg)
+	return true
+}
+
+// applyDeferred applies the packets that arrived during the initial transfer.
+// Packets arriving later are applied immediately.
+func (collection *Collection) applyDeferred() {
+	collection.deferredMutex.Lock()
+	defer collection.deferredMutex.Unlock()
+
+	for _, msg := range collection.deferred {
+		packetTime, _, _, data, err := readPacketHeader(msg)
+
+		if err == nil {
+			switch msg.Type {
+			case packetSet:
+				err = collection.applySet(packetTime, data)
+
+			case packetDelete:
+				err = collection.applyDelete(packetTime, data)
+
+			case packetBatch:
+				err = collection.applyBatch(packetTime, data)
+			}
+		}
+
+		// The transfer already contains most of the modifications
+		if err != nil && err != errOutdatedPacket {
+			fmt.Println("Error applying modification of collection", collection.name, "received during the transfer:", err)
+		}
+	}
+
+	collection.deferred = nil
+	collection.deferring = false
+}
+
+// isLoaded reports whether the collection has finished loading.
+func (collection *Collection) isLoaded() bool {
+	select {
+	case <-collection.loaded:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,38 @@
+package nano
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/akyoto/assert"
+)
+
+func TestTransferLazy(t *testing.T) {
+	node := New(Configuration{Port: 3000, Directory: t.TempDir()})
+	defer node.Close()
+
+	collection := node.Namespace("test").RegisterTypeAs("Item", &[]byte{}).Collection("Item")
+	collection.Set("1", []byte("1"))
+
+	// Lazy clients only get the header when a delta is not possible
+	for _, lazy := range []bool{false, true} {
+		buffer := bytes.Buffer{}
+		writer := bufio.NewWriter(&buffer)
+		assert.Nil(t, collection.writeTransfer(writer, 0, lazy))
+		assert.Nil(t, writer.Flush())
+
+		header, records, _ := strings.Cut(buffer.String(), "\n")
+		mode, _, _, err := parseTransferHeader(header)
+		assert.Nil(t, err)
+
+		if lazy {
+			assert.Equal(t, transferKeys, mode)
+			assert.Equal(t, "", records)
+		} else {
+			assert.Equal(t, transferFull, mode)
+			assert.NotEqual(t, "", records)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package nano
+
+import (
+	"errors"
+	"iter"
+	"reflect"
+)
+
+// TypedCollection is a type-safe handle for a collection storing values of type T.
+type TypedCollection[T any] struct {
+	collection *Collection
+}
+
+// Typed returns a type-safe handle for the collection that has been registered for type T.
+func Typed[T any](ns *Namespace) (*TypedCollection[T], error) {
+	typeInfo := reflect.TypeOf((*T)(nil)).Elem()
+	name, exists := ns.typeNames.Load(typeInfo)
+
+	if !exists {
+		return nil, errors.New("Type " + typeName(typeInfo) + " has not been registered")
+	}
+
+	collection, err := ns.CollectionE(name.(string))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TypedCollection[T]{
+		collection: collection,
+	}, nil
+}
+
+// Collection returns the untyped collection.
+func (typed *TypedCollection[T]) Collection() *Collection {
+	return typed.collection
+}
+
+// Get returns the value for the given key.
+func (typed *TypedCollection[T]) Get(key string) (*T, error) {
+	obj, err := typed.collection.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return typed.cast(key, obj)
+}
+
+// Set sets the value for the key.
+func (typed *TypedCollection[T]) Set(key string, value *T) {
+	typed.collection.Set(key, value)
+}
+
+// SetE sets the value for the key and returns an error if it can not be stored.
+func (typed *TypedCollection[T]) SetE(key string, value *T) error {
+	return typed.collection.SetE(key, value)
+}
+
+// Delete deletes a key from the collection.
+func (typed *TypedCollection[T]) Delete(key string) bool {
+	return typed.collection.Delete(key)
+}
+
+// Exists returns whether or not the key exists.
+func (typed *TypedCollection[T]) Exists(key string) bool {
+	return typed.collection.Exists(key)
+}
+
+// Count returns the number of elements in the collection.
+func (typed *TypedCollection[T]) Count() int64 {
+	return typed.collection.Count()
+}
+
+// Update atomically replaces the value for the key with the result of the update function.
+// See Collection.Update for details.
+func (typed *TypedCollection[T]) Update(key string, update func(old *T) (*T, error)) error {
+	return typed.collection.Update(key, func(old interface{}) (interface{}, error) {
+		var oldValue *T
+
+		if old != nil {
+			var err error
+			oldValue, err = typed.cast(key, old)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		value, err := update(oldValue)
+
+		if value == nil || err != nil {
+			return nil, err
+		}
+
+		return value, nil
+	})
+}
+
+// All iterates over all key/value pairs in the collection.
+// Values of a different type are skipped.
+func (typed *TypedCollection[T]) All() iter.Seq2[string, *T] {
+	return func(yield func(string, *T) bool) {
+		typed.collection.ForEach(func(key string, obj interface{}) bool {
+			value, err := typed.cast(key, obj)
+
+			if err != nil {
+				return true
+			}
+
+			return yield(key, value)
+		})
+	}
+}
+
+// cast converts a stored value to *T.
+func (typed *TypedCollection[T]) cast(key string, obj interface{}) (*T, error) {
+	switch value := obj.(type) {
+	case *T:
+		return value, nil
+
+	case T:
+		return &value, nil
+
+	default:
+		return nil, errors.New("Value of key " + key + " has type " + reflect.TypeOf(obj).String())
+	}
+}
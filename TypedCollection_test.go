@@ -0,0 +1,76 @@
+package nano_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestTypedCollection(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users, err := nano.Typed[User](node.Namespace("test").RegisterTypes(types...))
+	assert.Nil(t, err)
+
+	users.Set("1", newUser(1))
+	users.Set("2", newUser(2))
+
+	user, err := users.Get("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", user.ID)
+
+	_, err = users.Get("404")
+	assert.NotNil(t, err)
+
+	err = users.Update("2", func(old *User) (*User, error) {
+		old.Name = "Updated"
+		return old, nil
+	})
+
+	assert.Nil(t, err)
+
+	count := 0
+
+	for key, user := range users.All() {
+		assert.Equal(t, key, user.ID)
+		count++
+	}
+
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(2), users.Count())
+	assert.True(t, users.Delete("1"))
+	assert.False(t, users.Exists("1"))
+}
+
+func TestTypedCollectionAlias(t *testing.T) {
+	type User struct {
+		Name string
+	}
+
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	ns := node.Namespace("test").RegisterTypes(types...)
+
+	// Same type name from a different scope needs a different collection name
+	ns.RegisterTypeAs("LocalUser", (*User)(nil))
+	localUsers, err := nano.Typed[User](ns)
+	assert.Nil(t, err)
+	localUsers.Set("1", &User{Name: "Local"})
+	assert.True(t, ns.Collection("LocalUser").Exists("1"))
+	assert.False(t, ns.Collection("User").Exists("1"))
+
+	_, err = nano.Typed[struct{}](ns)
+	assert.NotNil(t, err)
+
+	// Same type name from a different scope collides
+	assert.NotNil(t, ns.RegisterTypesE((*User)(nil)))
+	assert.NotNil(t, ns.RegisterTypeAsE("LocalUser", types[0]))
+	assert.Nil(t, ns.RegisterTypesE(types...))
+	assert.NotEqual(t, reflect.TypeOf(User{}), ns.Types()["User"])
+}
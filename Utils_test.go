@@ -1,6 +1,8 @@
 package nano_test
 
 import (
+	"os"
+	"path"
 	"strconv"
 
 	"github.com/aerogo/nano"
@@ -40,3 +42,14 @@ var types = []interface{}{
 }
 
 var config = nano.Configuration{Port: port}
+
+// namespaceDirectory returns the directory used by the namespace with the default configuration.
+func namespaceDirectory(name string) string {
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		panic(err)
+	}
+
+	return path.Join(home, ".aero", "db", name)
+}
@@ -0,0 +1,180 @@
+package nano
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Operation is the type of modification described by a change.
+type Operation int
+
+const (
+	// OperationSet means that a value has been stored for the key.
+	OperationSet Operation = iota
+
+	// OperationDelete means that the key has been deleted.
+	OperationDelete
+)
+
+// Origin tells you where a change has been made.
+type Origin int
+
+const (
+	// OriginLocal is a change made by this node.
+	OriginLocal Origin = iota
+
+	// OriginRemote is a change received from another node.
+	OriginRemote
+)
+
+// Change describes a single modification of a collection.
+type Change struct {
+	// Operation is either OperationSet or OperationDelete.
+	Operation Operation
+
+	// Key is the modified key.
+	Key string
+
+	// Old is the previous value or nil if the key didn't exist.
+	Old interface{}
+
+	// New is the new value or nil if the key has been deleted.
+	New interface{}
+
+	// Origin tells you whether the change was made locally or by a remote node.
+	Origin Origin
+
+	// Timestamp is the modification time in nanoseconds, taken from a hybrid logical clock.
+	Timestamp int64
+}
+
+// watcher is a single subscription to the changes of a collection.
+// Changes are queued by the writers and delivered to the channel
+// by a separate goroutine, so that writers never wait for slow readers.
+type watcher struct {
+	channel chan Change
+	done    <-chan struct{}
+	match   func(key string) bool
+	queue   []Change
+	queued  chan struct{}
+	mutex   sync.Mutex
+}
+
+// watchers holds all subscriptions of a collection.
+type watchers struct {
+	list  []*watcher
+	count int32
+	mutex sync.RWMutex
+}
+
+// Watch returns a channel that receives all changes of the collection
+// until the context is cancelled. The channel is closed afterwards.
+// Writes to the collection don't wait for watchers to receive the change.
+// Changes are queued in memory instead, so the channel should be read continuously.
+func (collection *Collection) Watch(ctx context.Context) <-chan Change {
+	return collection.watch(ctx, nil)
+}
+
+// WatchKey is the same as Watch, except it only receives changes of the given key.
+func (collection *Collection) WatchKey(ctx context.Context, key string) <-chan Change {
+	return collection.watch(ctx, func(changedKey string) bool {
+		return changedKey == key
+	})
+}
+
+// WatchPrefix is the same as Watch, except it only receives changes of keys with the given prefix.
+func (collection *Collection) WatchPrefix(ctx context.Context, prefix string) <-chan Change {
+	return collection.watch(ctx, func(changedKey string) bool {
+		return strings.HasPrefix(changedKey, prefix)
+	})
+}
+
+// watch registers a new watcher with an optional key filter.
+func (collection *Collection) watch(ctx context.Context, match func(key string) bool) <-chan Change {
+	w := &watcher{
+		channel: make(chan Change, ChannelBufferSize),
+		done:    ctx.Done(),
+		match:   match,
+		queued:  make(chan struct{}, 1),
+	}
+
+	collection.watchers.mutex.Lock()
+	collection.watchers.list = append(collection.watchers.list, w)
+	atomic.AddInt32(&collection.watchers.count, 1)
+	collection.watchers.mutex.Unlock()
+
+	go func() {
+		w.deliver()
+		collection.watchers.mutex.Lock()
+
+		for i, existing := range collection.watchers.list {
+			if existing == w {
+				collection.watchers.list = append(collection.watchers.list[:i], collection.watchers.list[i+1:]...)
+				break
+			}
+		}
+
+		atomic.AddInt32(&collection.watchers.count, -1)
+		collection.watchers.mutex.Unlock()
+		close(w.channel)
+	}()
+
+	return w.channel
+}
+
+// notify queues the change for all interested watchers.
+// It is called while the key lock is held and therefore never blocks.
+func (collection *Collection) notify(change Change) {
+	if atomic.LoadInt32(&collection.watchers.count) == 0 {
+		return
+	}
+
+	collection.watchers.mutex.RLock()
+	defer collection.watchers.mutex.RUnlock()
+
+	for _, w := range collection.watchers.list {
+		if w.match != nil && !w.match(change.Key) {
+			continue
+		}
+
+		w.push(change)
+	}
+}
+
+// push adds the change to the queue of the watcher.
+func (w *watcher) push(change Change) {
+	w.mutex.Lock()
+	w.queue = append(w.queue, change)
+	w.mutex.Unlock()
+
+	select {
+	case w.queued <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued changes to the channel in order until the context is cancelled.
+func (w *watcher) deliver() {
+	for {
+		select {
+		case <-w.queued:
+		case <-w.done:
+			return
+		}
+
+		w.mutex.Lock()
+		changes := w.queue
+		w.queue = nil
+		w.mutex.Unlock()
+
+		for _, change := range changes {
+			select {
+			case w.channel <- change:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package nano_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+func TestCollectionWatch(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	users.Delete("watch:1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := users.WatchPrefix(ctx, "watch:")
+
+	first := newUser(1)
+	second := newUser(2)
+	users.Set("ignored", first)
+	users.Set("watch:1", first)
+	users.Set("watch:1", second)
+	users.Delete("watch:1")
+
+	change := <-changes
+	assert.Equal(t, nano.OperationSet, change.Operation)
+	assert.Equal(t, "watch:1", change.Key)
+	assert.Nil(t, change.Old)
+	assert.Equal(t, first, change.New)
+	assert.Equal(t, nano.OriginLocal, change.Origin)
+	assert.True(t, change.Timestamp > 0)
+
+	change = <-changes
+	assert.Equal(t, nano.OperationSet, change.Operation)
+	assert.Equal(t, first, change.Old)
+	assert.Equal(t, second, change.New)
+
+	change = <-changes
+	assert.Equal(t, nano.OperationDelete, change.Operation)
+	assert.Equal(t, second, change.Old)
+	assert.Nil(t, change.New)
+
+	// Cancelling the context closes the channel
+	cancel()
+	_, ok := <-changes
+	assert.False(t, ok)
+}
+
+func TestCollectionWatchSlowReader(t *testing.T) {
+	node := nano.New(config)
+	defer node.Close()
+	defer node.Clear()
+
+	users := node.Namespace("test").RegisterTypes(types...).Collection("User")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Writes don't wait for watchers that don't read
+	changes := users.Watch(ctx)
+	count := nano.ChannelBufferSize * 4
+	written := make(chan struct{})
+
+	go func() {
+		for i := 0; i < count; i++ {
+			users.Set(strconv.Itoa(i), newUser(i))
+		}
+
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writes are blocked by the watcher")
+	}
+
+	for i := 0; i < count; i++ {
+		change := <-changes
+		assert.Equal(t, strconv.Itoa(i), change.Key)
+	}
+}
+
+func TestClusterWatch(t *testing.T) {
+	server := nano.New(config)
+	client := nano.New(config)
+
+	// Wait for the client to connect
+	for server.Server().ClientCount() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverUsers := server.Namespace("test").RegisterTypes(types...).Collection("User")
+	clientUsers := client.Namespace("test").RegisterTypes(types...).Collection("User")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := serverUsers.WatchKey(ctx, "remote")
+	clientUsers.Set("remote", newUser(1))
+
+	select {
+	case change := <-changes:
+		assert.Equal(t, nano.OriginRemote, change.Origin)
+		assert.Equal(t, "1", change.New.(*User).ID)
+
+	case <-time.After(time.Second):
+		t.Fatal("Remote change has not been received")
+	}
+
+	client.Clear()
+	client.Close()
+	server.Clear()
+	server.Close()
+}
@@ -0,0 +1,426 @@
+// nano inspects and edits the databases stored by nano nodes.
+//
+// If a server node is running on the port, the commands are sent to it
+// over the network. Otherwise the tool loads the collection files itself.
+// The codec of a collection is detected unless it is set with the -codec flag.
+//
+//	nano [flags] <command> [arguments]
+//
+// Commands:
+//
+//	namespaces                                  list all namespaces
+//	collections <namespace>                     list all collections of the namespace with their counts
+//	count <namespace> <collection>              print the number of keys
+//	get <namespace> <collection> <key>          print the value of the key as JSON
+//	set <namespace> <collection> <key> <json>   set the value of the key
+//	delete <namespace> <collection> <key>       delete the key
+//	dump <namespace> <collection> [json|ndjson] print all keys and values
+//	compact <namespace> <collection>            fold the write-ahead log into the snapshot
+//	repair <namespace> <collection>             move damaged records to the .corrupt file
+//
+// Values are decoded without knowing their Go type, so the gob codec is not supported.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+
+	"github.com/aerogo/nano"
+)
+
+// usage describes the command line arguments.
+const usage = `Usage: nano [flags] <command> [arguments]
+
+Commands:
+  namespaces                                  list all namespaces
+  collections <namespace>                     list all collections of the namespace with their counts
+  count <namespace> <collection>              print the number of keys
+  get <namespace> <collection> <key>          print the value of the key as JSON
+  set <namespace> <collection> <key> <json>   set the value of the key
+  delete <namespace> <collection> <key>       delete the key
+  dump <namespace> <collection> [json|ndjson] print all keys and values
+  compact <namespace> <collection>            fold the write-ahead log into the snapshot
+  repair <namespace> <collection>             move damaged records to the .corrupt file
+
+Flags:
+`
+
+// argumentCount is the number of arguments required by each command.
+var argumentCount = map[string]int{
+	"namespaces":  0,
+	"collections": 1,
+	"count":       2,
+	"get":         3,
+	"set":         4,
+	"delete":      3,
+	"dump":        2,
+	"compact":     2,
+	"repair":      2,
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command line and writes the results to the output.
+func run(args []string, output io.Writer, errorOutput io.Writer) error {
+	flags := flag.NewFlagSet("nano", flag.ContinueOnError)
+	flags.SetOutput(errorOutput)
+	directory := flags.String("dir", "", "database directory, defaults to ~/.aero/db")
+	port := flags.Int("port", 3000, "port of the server node")
+	codecName := flags.String("codec", "", "codec of the collection: json, msgpack or raw, detected by default")
+
+	flags.Usage = func() {
+		fmt.Fprint(errorOutput, usage)
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	args = flags.Args()
+
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("No command given")
+	}
+
+	command := args[0]
+	args = args[1:]
+	count, exists := argumentCount[command]
+
+	if !exists {
+		return errors.New("Unknown command: " + command)
+	}
+
+	if len(args) < count || (len(args) > count && command != "dump") || len(args) > count+1 {
+		return fmt.Errorf("%s expects %d arguments", command, count)
+	}
+
+	if *directory == "" {
+		home, err := user.Current()
+
+		if err != nil {
+			return err
+		}
+
+		*directory = path.Join(home.HomeDir, ".aero", "db")
+	}
+
+	node, err := nano.Open(nano.Configuration{
+		Port:      *port,
+		Directory: *directory,
+
+		// Single keys are fetched from a running server instead of whole collections
+		Lazy: command == "get" || command == "set" || command == "delete",
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer node.Close()
+
+	db := &database{
+		node:      node,
+		codecName: *codecName,
+		create:    command == "set",
+	}
+
+	switch command {
+	case "namespaces":
+		names, err := node.Namespaces()
+
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			fmt.Fprintln(output, name)
+		}
+
+		return nil
+
+	case "collections":
+		return db.listCollections(output, args[0])
+
+	case "repair":
+		_, err := db.namespace(args[0], args[1])
+
+		if err != nil {
+			return err
+		}
+
+		corruptRecords, err := node.Repair(args[0], args[1])
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(output, corruptRecords, "damaged records")
+		return nil
+	}
+
+	collection, err := db.collection(args[0], args[1])
+
+	if err != nil {
+		return err
+	}
+
+	codec := collection.Codec()
+
+	switch command {
+	case "count":
+		fmt.Fprintln(output, collection.Count())
+
+	case "get":
+		value, err := collection.Get(args[2])
+
+		if err != nil {
+			return err
+		}
+
+		if codec.Name() == "raw" {
+			fmt.Fprintln(output, string(*value.(*[]byte)))
+			return nil
+		}
+
+		return printJSON(output, value)
+
+	case "set":
+		if codec.Name() == "raw" {
+			return collection.SetE(args[2], []byte(args[3]))
+		}
+
+		if !json.Valid([]byte(args[3])) {
+			return errors.New("Invalid JSON value: " + args[3])
+		}
+
+		if codec.Name() == "json" {
+			return collection.SetE(args[2], json.RawMessage(args[3]))
+		}
+
+		var value interface{}
+		err := json.Unmarshal([]byte(args[3]), &value)
+
+		if err != nil {
+			return err
+		}
+
+		return collection.SetE(args[2], value)
+
+	case "delete":
+		exists, err := collection.DeleteE(args[2])
+
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return errors.New("Key not found: " + args[2])
+		}
+
+	case "dump":
+		format := "json"
+
+		if len(args) > 2 {
+			format = args[2]
+		}
+
+		return dump(output, collection, format)
+
+	case "compact":
+		return collection.Compact()
+	}
+
+	return nil
+}
+
+// database gives access to the collections of a node,
+// which is a client if a server is running on the port.
+type database struct {
+	node      *nano.Node
+	codecName string
+	create    bool
+}
+
+// collection loads the collection with a type that can hold any value.
+func (db *database) collection(namespace string, name string) (*nano.Collection, error) {
+	ns, err := db.namespace(namespace, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ns.CollectionE(name)
+}
+
+// namespace returns the namespace after registering the collection
+// with a type that can hold any value.
+func (db *database) namespace(namespace string, name string) (*nano.Namespace, error) {
+	infos, err := db.node.Collections(namespace)
+
+	if err != nil && !db.create {
+		return nil, err
+	}
+
+	codecName := "json"
+	found := false
+
+	for _, info := range infos {
+		if info.Name == name {
+			codecName = info.Codec
+			found = true
+		}
+	}
+
+	// The collection needs to exist unless it is created
+	if !found && !db.create {
+		return nil, errors.New("Collection not found: " + namespace + "/" + name)
+	}
+
+	if db.codecName != "" {
+		codecName = db.codecName
+	}
+
+	codec, err := codecByName(codecName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := db.node.NamespaceE(namespace)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON values are kept as they are
+	switch codec.Name() {
+	case "json":
+		err = ns.RegisterTypeAsE(name, &json.RawMessage{})
+
+	case "raw":
+		err = ns.RegisterTypeAsE(name, &[]byte{})
+
+	default:
+		err = ns.RegisterTypeAsE(name, (*interface{})(nil))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ns.SetCodec(codec, name)
+	return ns, nil
+}
+
+// listCollections prints the collections of the namespace together with their counts.
+func (db *database) listCollections(output io.Writer, namespace string) error {
+	infos, err := db.node.Collections(namespace)
+
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		collection, err := db.collection(namespace, info.Name)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(output, info.Name, collection.Count())
+	}
+
+	return nil
+}
+
+// dump prints all keys and values of the collection as a single JSON object
+// or as one JSON object per line with the key and the value.
+func dump(output io.Writer, collection *nano.Collection, format string) error {
+	switch format {
+	case "json":
+		values := map[string]interface{}{}
+
+		collection.ForEach(func(key string, value interface{}) bool {
+			values[key] = value
+			return true
+		})
+
+		return printJSON(output, values)
+
+	case "ndjson":
+		for _, key := range collection.Keys() {
+			value, err := collection.Get(key)
+
+			if err != nil {
+				continue
+			}
+
+			line, err := json.Marshal(map[string]interface{}{"key": key, "value": value})
+
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(output, string(line))
+		}
+
+		return nil
+
+	default:
+		return errors.New("Unknown dump format: " + format)
+	}
+}
+
+// printJSON prints the value as indented JSON.
+func printJSON(output io.Writer, value interface{}) error {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	buffer := bytes.Buffer{}
+	err = json.Indent(&buffer, data, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(output, buffer.String())
+	return nil
+}
+
+// codecByName returns the codec with the given name.
+func codecByName(name string) (nano.Codec, error) {
+	switch name {
+	case "json":
+		return nano.JSON(), nil
+
+	case "msgpack":
+		return nano.MessagePack(), nil
+
+	case "raw":
+		return nano.Raw(), nil
+
+	default:
+		return nil, errors.New("Unsupported codec: " + name)
+	}
+}
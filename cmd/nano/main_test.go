@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerogo/nano"
+	"github.com/akyoto/assert"
+)
+
+type Item struct {
+	Name string
+}
+
+// command returns a function that runs the tool with the directory and the port.
+func command(directory string, port string) func(args ...string) (string, error) {
+	return func(args ...string) (string, error) {
+		output := bytes.Buffer{}
+		args = append([]string{"-dir", directory, "-port", port}, args...)
+		err := run(args, &output, &bytes.Buffer{})
+		return strings.TrimSpace(output.String()), err
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tool := command(t.TempDir(), "3099")
+	_, err := tool("count", "test", "Item")
+	assert.NotNil(t, err)
+
+	_, err = tool("set", "test", "Item", "1", `{"name":"first"}`)
+	assert.Nil(t, err)
+
+	_, err = tool("set", "test", "Item", "2", `{"name":"second"}`)
+	assert.Nil(t, err)
+
+	_, err = tool("set", "test", "Item", "3", `{invalid`)
+	assert.NotNil(t, err)
+
+	output, err := tool("get", "test", "Item", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n\t\"name\": \"first\"\n}", output)
+
+	_, err = tool("delete", "test", "Item", "2")
+	assert.Nil(t, err)
+
+	_, err = tool("delete", "test", "Item", "2")
+	assert.NotNil(t, err)
+
+	output, err = tool("dump", "test", "Item", "ndjson")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"key":"1","value":{"name":"first"}}`, output)
+
+	_, err = tool("compact", "test", "Item")
+	assert.Nil(t, err)
+
+	output, err = tool("collections", "test")
+	assert.Nil(t, err)
+	assert.Equal(t, "Item 1", output)
+
+	output, err = tool("namespaces")
+	assert.Nil(t, err)
+	assert.Equal(t, "test", output)
+
+	_, err = tool("unknown")
+	assert.NotNil(t, err)
+}
+
+func TestCommandsCodec(t *testing.T) {
+	directory := t.TempDir()
+	node := nano.New(nano.Configuration{Port: 3099, Directory: directory})
+	items := node.Namespace("test").RegisterTypes((*Item)(nil)).SetCodec(nano.MessagePack(), "Item").Collection("Item")
+	items.Set("1", &Item{Name: "first"})
+	node.Close()
+
+	// The codec is read from the files
+	tool := command(directory, "3099")
+	output, err := tool("count", "test", "Item")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", output)
+
+	output, err = tool("get", "test", "Item", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n\t\"Name\": \"first\"\n}", output)
+
+	_, err = tool("-codec", "json", "get", "test", "Item", "1")
+	assert.NotNil(t, err)
+}
+
+func TestCommandsServer(t *testing.T) {
+	server := nano.New(nano.Configuration{Port: 3098, Directory: t.TempDir()})
+	defer server.Close()
+
+	items := server.Namespace("test").RegisterTypes((*Item)(nil)).SetCodec(nano.MessagePack(), "Item").Collection("Item")
+	items.Set("1", &Item{Name: "first"})
+	items.Set("2", &Item{Name: "second"})
+
+	// The tool has no files of its own, everything comes from the server
+	tool := command(t.TempDir(), "3098")
+
+	output, err := tool("namespaces")
+	assert.Nil(t, err)
+	assert.Equal(t, "test", output)
+
+	output, err = tool("collections", "test")
+	assert.Nil(t, err)
+	assert.Equal(t, "Item 2", output)
+
+	output, err = tool("get", "test", "Item", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n\t\"Name\": \"second\"\n}", output)
+
+	_, err = tool("set", "test", "Item", "3", `{"Name":"third"}`)
+	assert.Nil(t, err)
+
+	_, err = tool("delete", "test", "Item", "1")
+	assert.Nil(t, err)
+
+	_, err = tool("count", "test", "Unknown")
+	assert.NotNil(t, err)
+
+	// Wait until the modifications arrive at the server
+	time.Sleep(300 * time.Millisecond)
+
+	item, err := items.Get("3")
+	assert.Nil(t, err)
+	assert.Equal(t, "third", item.(*Item).Name)
+	assert.False(t, items.Exists("1"))
+
+	output, err = tool("dump", "test", "Item", "ndjson")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"key":"2","value":{"Name":"second"}}
+{"key":"3","value":{"Name":"third"}}`, output)
+}